@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	recordsBucket = []byte("records")
+	cellsBucket   = []byte("cells")
+	stateBucket   = []byte("state")
+	historyBucket = []byte("history")
+	sharesBucket  = []byte("shares")
+	// subscribersBucket holds a nested bucket per owner mapping record names to JSON arrays of subscribers.
+	subscribersBucket = []byte("subscribers")
+	// subscriptionsBucket holds a nested bucket per subscriber mapping "<uid>/<name>" to a JSON RecordRef.
+	subscriptionsBucket = []byte("subscriptions")
+	outboxBucket        = []byte("outbox")
+	inactiveBucket      = []byte("inactive")
+)
+
+// boltStorage keeps the same data as the redis backend in a single file.
+// The records, cells and history buckets hold one nested bucket per user, keyed by the user id.
+// The history of a record is stored as a JSON encoded array.
+// The state bucket maps the user id to a JSON encoded storedState,
+// the shares bucket maps invite codes to JSON encoded RecordRefs
+// the outbox bucket maps the ids of undelivered notifications to JSON encoded OutboxMessages
+// and the inactive bucket holds the ids of the chats that have blocked the bot.
+type boltStorage struct {
+	db *bolt.DB
+}
+
+func newBoltStorage(path string) *boltStorage {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		log.Panic(err.Error())
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{recordsBucket, cellsBucket, stateBucket, historyBucket, sharesBucket, subscribersBucket, subscriptionsBucket, outboxBucket, inactiveBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return purgeExpiredStates(tx.Bucket(stateBucket))
+	})
+	if err != nil {
+		log.Panic(err.Error())
+	}
+	return &boltStorage{db: db}
+}
+
+func purgeExpiredStates(b *bolt.Bucket) error {
+	var expired [][]byte
+	now := time.Now()
+	b.ForEach(func(k, v []byte) error {
+		var st storedState
+		if json.Unmarshal(v, &st) != nil || now.After(st.Expires) {
+			expired = append(expired, k)
+		}
+		return nil
+	})
+	for _, k := range expired {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func uidKey(uid int64) []byte {
+	return []byte(strconv.FormatInt(uid, 10))
+}
+
+func (s *boltStorage) get(bucket []byte, uid int64, name string) (res string, ok bool) {
+	s.db.View(func(tx *bolt.Tx) error {
+		res, ok = getTx(tx, bucket, uid, name)
+		return nil
+	})
+	return
+}
+
+func (s *boltStorage) put(bucket []byte, uid int64, name string, value string) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return putTx(tx, bucket, uid, name, value)
+	})
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func (s *boltStorage) delete(bucket []byte, uid int64, name string) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return deleteTx(tx, bucket, uid, name)
+	})
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// getTx, putTx and deleteTx work on the nested bucket of the user within a transaction.
+// The value returned by getTx is a copy, as bolt only keeps its own until the transaction ends.
+func getTx(tx *bolt.Tx, bucket []byte, uid int64, name string) (string, bool) {
+	b := tx.Bucket(bucket).Bucket(uidKey(uid))
+	if b == nil {
+		return "", false
+	}
+	val := b.Get([]byte(name))
+	return string(val), val != nil
+}
+
+func putTx(tx *bolt.Tx, bucket []byte, uid int64, name string, value string) error {
+	b, err := tx.Bucket(bucket).CreateBucketIfNotExists(uidKey(uid))
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(name), []byte(value))
+}
+
+func deleteTx(tx *bolt.Tx, bucket []byte, uid int64, name string) error {
+	parent := tx.Bucket(bucket)
+	b := parent.Bucket(uidKey(uid))
+	if b == nil {
+		return nil
+	}
+	if err := b.Delete([]byte(name)); err != nil {
+		return err
+	}
+	if k, _ := b.Cursor().First(); k == nil {
+		return parent.DeleteBucket(uidKey(uid))
+	}
+	return nil
+}
+
+func (s *boltStorage) RecordExists(uid int64, name string) bool {
+	_, ok := s.get(recordsBucket, uid, name)
+	return ok
+}
+
+func (s *boltStorage) GetRecord(uid int64, name string) (string, bool) {
+	return s.get(recordsBucket, uid, name)
+}
+
+func (s *boltStorage) AddRecord(uid int64, name string, record string) {
+	s.put(recordsBucket, uid, name, record)
+}
+
+func (s *boltStorage) RecordList(uid int64) StringPairs {
+	m := make(map[string]string)
+	s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(recordsBucket).Bucket(uidKey(uid))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			m[string(k)] = string(v)
+			return nil
+		})
+	})
+	return sortedPairs(m)
+}
+
+func (s *boltStorage) DeleteRecord(uid int64, name string) {
+	s.delete(recordsBucket, uid, name)
+}
+
+func (s *boltStorage) UserList() []int64 {
+	res := make([]int64, 0)
+	s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(recordsBucket).ForEach(func(k, v []byte) error {
+			uid, err := strconv.ParseInt(string(k), 10, 64)
+			if err == nil {
+				res = append(res, uid)
+			}
+			return nil
+		})
+	})
+	return res
+}
+
+func (s *boltStorage) GetCellVal(uid int64, name string) (string, bool) {
+	return s.get(cellsBucket, uid, name)
+}
+
+func (s *boltStorage) UpdateCellVal(uid int64, name string, value string) string {
+	old := value
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(cellsBucket).CreateBucketIfNotExists(uidKey(uid))
+		if err != nil {
+			return err
+		}
+		if v := b.Get([]byte(name)); v != nil {
+			old = string(v)
+		}
+		return b.Put([]byte(name), []byte(value))
+	})
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return old
+}
+
+func (s *boltStorage) DeleteCellVal(uid int64, name string) {
+	s.delete(cellsBucket, uid, name)
+}
+
+func (s *boltStorage) AddHistory(uid int64, name string, entry HistoryEntry, limit int) {
+	if limit <= 0 {
+		s.delete(historyBucket, uid, name)
+		return
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(historyBucket).CreateBucketIfNotExists(uidKey(uid))
+		if err != nil {
+			return err
+		}
+		var h []HistoryEntry
+		if v := b.Get([]byte(name)); v != nil {
+			json.Unmarshal(v, &h)
+		}
+		h = append(h, entry)
+		if len(h) > limit {
+			h = h[len(h)-limit:]
+		}
+		data, err := json.Marshal(h)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(name), data)
+	})
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func (s *boltStorage) History(uid int64, name string) []HistoryEntry {
+	res := make([]HistoryEntry, 0)
+	if v, ok := s.get(historyBucket, uid, name); ok {
+		json.Unmarshal([]byte(v), &res)
+	}
+	return res
+}
+
+func (s *boltStorage) DeleteHistory(uid int64, name string) {
+	s.delete(historyBucket, uid, name)
+}
+
+func (s *boltStorage) GetState(uid int64) map[string]string {
+	var st storedState
+	s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(stateBucket).Get(uidKey(uid)); v != nil {
+			json.Unmarshal(v, &st)
+		}
+		return nil
+	})
+	if st.Values == nil || time.Now().After(st.Expires) {
+		return make(map[string]string)
+	}
+	return st.Values
+}
+
+func (s *boltStorage) SetState(uid int64, state map[string]string, ttl time.Duration) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(stateBucket)
+		if len(state) == 0 {
+			return b.Delete(uidKey(uid))
+		}
+		data, err := json.Marshal(storedState{state, time.Now().Add(ttl)})
+		if err != nil {
+			return err
+		}
+		return b.Put(uidKey(uid), data)
+	})
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func (s *boltStorage) AddShare(code string, rec RecordRef) {
+	data, _ := json.Marshal(rec)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sharesBucket).Put([]byte(code), data)
+	})
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func (s *boltStorage) GetShare(code string) (RecordRef, bool) {
+	var rec RecordRef
+	ok := false
+	s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(sharesBucket).Get([]byte(code)); v != nil {
+			ok = json.Unmarshal(v, &rec) == nil
+		}
+		return nil
+	})
+	return rec, ok
+}
+
+func (s *boltStorage) DeleteShare(code string) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sharesBucket).Delete([]byte(code))
+	})
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func subscriptionKey(rec RecordRef) string {
+	return strconv.FormatInt(rec.Uid, 10) + "/" + rec.Name
+}
+
+// Subscribe and Unsubscribe change both directions of the relation in one transaction,
+// so that concurrent changes of the same record do not lose subscribers.
+func (s *boltStorage) Subscribe(sub int64, rec RecordRef) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		subs := subscribersTx(tx, rec)
+		for _, v := range subs {
+			if v == sub {
+				return nil
+			}
+		}
+		data, _ := json.Marshal(append(subs, sub))
+		if err := putTx(tx, subscribersBucket, rec.Uid, rec.Name, string(data)); err != nil {
+			return err
+		}
+		data, _ = json.Marshal(rec)
+		return putTx(tx, subscriptionsBucket, sub, subscriptionKey(rec), string(data))
+	})
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func (s *boltStorage) Unsubscribe(sub int64, rec RecordRef) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		subs := make([]int64, 0)
+		for _, v := range subscribersTx(tx, rec) {
+			if v != sub {
+				subs = append(subs, v)
+			}
+		}
+		var err error
+		if len(subs) == 0 {
+			err = deleteTx(tx, subscribersBucket, rec.Uid, rec.Name)
+		} else {
+			data, _ := json.Marshal(subs)
+			err = putTx(tx, subscribersBucket, rec.Uid, rec.Name, string(data))
+		}
+		if err != nil {
+			return err
+		}
+		return deleteTx(tx, subscriptionsBucket, sub, subscriptionKey(rec))
+	})
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func subscribersTx(tx *bolt.Tx, rec RecordRef) []int64 {
+	res := make([]int64, 0)
+	if v, ok := getTx(tx, subscribersBucket, rec.Uid, rec.Name); ok {
+		json.Unmarshal([]byte(v), &res)
+	}
+	return res
+}
+
+func (s *boltStorage) Subscribers(rec RecordRef) (res []int64) {
+	s.db.View(func(tx *bolt.Tx) error {
+		res = subscribersTx(tx, rec)
+		return nil
+	})
+	return
+}
+
+func (s *boltStorage) Subscriptions(sub int64) []RecordRef {
+	res := make([]RecordRef, 0)
+	s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(subscriptionsBucket).Bucket(uidKey(sub))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var rec RecordRef
+			if json.Unmarshal(v, &rec) == nil {
+				res = append(res, rec)
+			}
+			return nil
+		})
+	})
+	return res
+}
+
+func (s *boltStorage) AddOutbox(msg OutboxMessage) {
+	data, _ := json.Marshal(msg)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).Put([]byte(msg.ID), data)
+	})
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// Outbox relies on bolt keeping the keys sorted.
+func (s *boltStorage) Outbox() []OutboxMessage {
+	res := make([]OutboxMessage, 0)
+	s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).ForEach(func(k, v []byte) error {
+			var msg OutboxMessage
+			if json.Unmarshal(v, &msg) == nil {
+				res = append(res, msg)
+			}
+			return nil
+		})
+	})
+	return res
+}
+
+func (s *boltStorage) DeleteOutbox(id string) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).Delete([]byte(id))
+	})
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func (s *boltStorage) SetInactive(chat int64, inactive bool) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if inactive {
+			return tx.Bucket(inactiveBucket).Put(uidKey(chat), []byte{})
+		}
+		return tx.Bucket(inactiveBucket).Delete(uidKey(chat))
+	})
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func (s *boltStorage) IsInactive(chat int64) bool {
+	res := false
+	s.db.View(func(tx *bolt.Tx) error {
+		res = tx.Bucket(inactiveBucket).Get(uidKey(chat)) != nil
+		return nil
+	})
+	return res
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// tableEntry is a fetched document together with the validators needed to revalidate it.
+type tableEntry struct {
+	key          string
+	data         string
+	etag         string
+	lastModified string
+	fetched      time.Time
+	// version changes every time the content of the document changes.
+	version uint64
+	parsed  *lazySheet
+}
+
+// lazySheet parses the document on first use. Entries of the same version share it,
+// so the document is parsed once no matter how many records point at it.
+type lazySheet struct {
+	once  sync.Once
+	parse func(data string) (*Sheet, error)
+	sheet *Sheet
+	err   error
+}
+
+func (e *tableEntry) Sheet() (*Sheet, error) {
+	e.parsed.once.Do(func() {
+		e.parsed.sheet, e.parsed.err = e.parsed.parse(e.data)
+	})
+	return e.parsed.sheet, e.parsed.err
+}
+
+var tableVersion uint64
+
+// fetchFunc downloads a document, revalidating it with the given validators if they are not empty.
+type fetchFunc func(etag string, lastModified string) (entry *tableEntry, notModified bool)
+
+type tableCache struct {
+	lock    sync.Mutex
+	entries map[string]*tableEntry
+	// failed keeps the time of the last failed fetch, so that a broken document
+	// is not requested again for every record pointing at it.
+	failed map[string]time.Time
+	group  singleflight.Group
+}
+
+var tables = tableCache{entries: make(map[string]*tableEntry), failed: make(map[string]time.Time)}
+
+// get returns the cached document if it is younger than ttl. Otherwise the document
+// is revalidated with a conditional request. Concurrent callers asking for the same
+// document share a single request.
+func (c *tableCache) get(key string, ttl time.Duration, fetch fetchFunc, parse func(data string) (*Sheet, error)) *tableEntry {
+	c.lock.Lock()
+	old := c.entries[key]
+	failed, hasFailed := c.failed[key]
+	c.lock.Unlock()
+	if old != nil && time.Since(old.fetched) < ttl {
+		return old
+	}
+	if hasFailed && time.Since(failed) < ttl {
+		return nil
+	}
+	res, _, _ := c.group.Do(key, func() (interface{}, error) {
+		var etag, lastModified string
+		if old != nil {
+			etag, lastModified = old.etag, old.lastModified
+		}
+		entry, notModified := fetch(etag, lastModified)
+		if notModified {
+			entry = &tableEntry{key, old.data, old.etag, old.lastModified, time.Now(), old.version, old.parsed}
+		} else if entry == nil {
+			c.lock.Lock()
+			c.failed[key] = time.Now()
+			c.lock.Unlock()
+			return (*tableEntry)(nil), nil
+		} else if old != nil && old.data == entry.data {
+			entry.key, entry.version, entry.parsed = key, old.version, old.parsed
+		} else {
+			entry.key, entry.version, entry.parsed = key, atomic.AddUint64(&tableVersion, 1), &lazySheet{parse: parse}
+		}
+		c.lock.Lock()
+		c.entries[key] = entry
+		delete(c.failed, key)
+		c.lock.Unlock()
+		return entry, nil
+	})
+	return res.(*tableEntry)
+}
+
+// prune drops the documents that nobody has fetched for longer than age.
+func (c *tableCache) prune(age time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key, entry := range c.entries {
+		if time.Since(entry.fetched) > age {
+			delete(c.entries, key)
+		}
+	}
+	for key, failed := range c.failed {
+		if time.Since(failed) > age {
+			delete(c.failed, key)
+		}
+	}
+}
+
+// getEntry returns the document fetched in the given mode. gid is ignored by the
+// formats that contain the whole document.
+func getEntry(mode string, name string, gid string) *tableEntry {
+	f := fetchers[mode]
+	if f == nil {
+		return nil
+	}
+	return tables.get(name+"#"+mode+"="+gid, configDuration("cachettl"), func(etag string, lastModified string) (*tableEntry, bool) {
+		return f.Fetch(name, gid, etag, lastModified)
+	}, func(data string) (*Sheet, error) {
+		return f.Parse(gid, data)
+	})
+}
+
+// getTabList returns the document the record belongs to with at least its list of tabs.
+// Both results are nil if it could not be fetched.
+func getTabList(rec *Record) (*Sheet, error) {
+	tabs := *rec
+	tabs.SetTabs()
+	_, sheet, err := recordSource(&tabs)
+	return sheet, err
+}
+
+const (
+	FETCH_HTML = "html"
+	FETCH_CSV  = "csv"
+	FETCH_API  = "api"
+	FETCH_AUTO = "auto"
+)
+
+// fetchMode returns how the record is fetched: its own option if set, the global setting otherwise.
+func fetchMode(rec *Record) string {
+	if mode := rec.Options["fetch"]; mode != "" {
+		return mode
+	}
+	return configMap["fetch"]
+}
+
+// recordSource fetches the document the record is evaluated against. In the auto mode
+// the HTML view is tried first, then the CSV export and then the Sheets API if it is configured.
+// The next source is used if the previous one cannot be fetched or does not contain the tab.
+// The CSV export cannot list tabs, so it is skipped for tab list records.
+// If no source contains the tab, the first document that could be read is returned,
+// so that a deleted tab can be told apart from a failed fetch.
+// The entry is nil if nothing could be fetched, and comes with the error if nothing could be parsed.
+func recordSource(rec *Record) (*tableEntry, *Sheet, error) {
+	var sources []string
+	switch mode := fetchMode(rec); mode {
+	case FETCH_AUTO:
+		sources = []string{FETCH_HTML, FETCH_CSV}
+		if fetchers[FETCH_API] != nil {
+			sources = append(sources, FETCH_API)
+		}
+	default:
+		sources = []string{mode}
+	}
+	var fallback, failed *tableEntry
+	var fallbackSheet *Sheet
+	var err error
+	for _, source := range sources {
+		gid := rec.Gid
+		switch source {
+		case FETCH_HTML:
+			gid = ""
+		case FETCH_CSV:
+			if rec.Kind == KIND_TABS {
+				continue
+			}
+		case FETCH_API:
+			if rec.Kind == KIND_TABS {
+				gid = ""
+			}
+		default:
+			return nil, nil, errors.New("Unknown fetch mode " + source)
+		}
+		entry := getEntry(source, rec.TableName(), gid)
+		if entry == nil {
+			continue
+		}
+		sheet, parseErr := entry.Sheet()
+		if parseErr != nil {
+			failed, err = entry, parseErr
+			continue
+		}
+		if rec.Kind == KIND_TABS || sheet.Tab(rec.Gid) != nil {
+			return entry, sheet, nil
+		}
+		if fallback == nil {
+			fallback, fallbackSheet = entry, sheet
+		}
+	}
+	if fallback != nil {
+		return fallback, fallbackSheet, nil
+	}
+	// Only documents that could not be parsed were fetched, if any
+	return failed, nil, err
+}
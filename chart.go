@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"strconv"
+	"time"
+)
+
+const (
+	CHART_WIDTH  = 640
+	CHART_HEIGHT = 320
+	CHART_MARGIN = 16
+)
+
+var (
+	chartBackground = color.RGBA{255, 255, 255, 255}
+	chartGrid       = color.RGBA{220, 220, 220, 255}
+	chartLine       = color.RGBA{33, 150, 243, 255}
+)
+
+type chartPoint struct {
+	t time.Time
+	v float64
+}
+
+// numericHistory picks the values of the history that are numbers.
+func numericHistory(history []HistoryEntry) []chartPoint {
+	var res []chartPoint
+	for _, entry := range history {
+		if v, ok := parseNumber(displayValue(entry.Value)); ok {
+			res = append(res, chartPoint{entry.Time, v})
+		}
+	}
+	return res
+}
+
+// drawChart renders the values as a step chart, since a cell keeps its value until
+// the next change. The last value is extended up to now.
+func drawChart(points []chartPoint, now time.Time) ([]byte, error) {
+	if len(points) < 2 {
+		return nil, errors.New("Not enough numeric values")
+	}
+	points = append(points, chartPoint{now, points[len(points)-1].v})
+	tmin, tmax := points[0].t, points[len(points)-1].t
+	vmin, vmax := points[0].v, points[0].v
+	for _, p := range points {
+		if p.v < vmin {
+			vmin = p.v
+		}
+		if p.v > vmax {
+			vmax = p.v
+		}
+	}
+	img := image.NewRGBA(image.Rect(0, 0, CHART_WIDTH, CHART_HEIGHT))
+	draw.Draw(img, img.Bounds(), &image.Uniform{chartBackground}, image.ZP, draw.Src)
+	left, right := CHART_MARGIN, CHART_WIDTH-CHART_MARGIN
+	top, bottom := CHART_MARGIN, CHART_HEIGHT-CHART_MARGIN
+	x := func(t time.Time) int {
+		if !tmax.After(tmin) {
+			return left
+		}
+		return left + int(float64(right-left)*float64(t.Sub(tmin))/float64(tmax.Sub(tmin)))
+	}
+	y := func(v float64) int {
+		if vmax == vmin {
+			return (top + bottom) / 2
+		}
+		return bottom - int(float64(bottom-top)*(v-vmin)/(vmax-vmin))
+	}
+	for i := 0; i <= 4; i++ {
+		hline(img, left, right, top+(bottom-top)*i/4, 1, chartGrid)
+	}
+	vline(img, left, top, bottom, 1, chartGrid)
+	for i := 1; i < len(points); i++ {
+		x1, x2 := x(points[i-1].t), x(points[i].t)
+		y1, y2 := y(points[i-1].v), y(points[i].v)
+		hline(img, x1, x2, y1, 2, chartLine)
+		vline(img, x2, y1, y2, 2, chartLine)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func hline(img *image.RGBA, x1 int, x2 int, y int, width int, c color.Color) {
+	if x1 > x2 {
+		x1, x2 = x2, x1
+	}
+	draw.Draw(img, image.Rect(x1, y-width/2, x2+1, y-width/2+width), &image.Uniform{c}, image.ZP, draw.Src)
+}
+
+func vline(img *image.RGBA, x int, y1 int, y2 int, width int, c color.Color) {
+	if y1 > y2 {
+		y1, y2 = y2, y1
+	}
+	draw.Draw(img, image.Rect(x-width/2, y1, x-width/2+width, y2+1), &image.Uniform{c}, image.ZP, draw.Src)
+}
+
+// chartCaption describes the chart, which has no text of its own.
+func chartCaption(name string, points []chartPoint) string {
+	vmin, vmax := points[0].v, points[0].v
+	for _, p := range points {
+		if p.v < vmin {
+			vmin = p.v
+		}
+		if p.v > vmax {
+			vmax = p.v
+		}
+	}
+	format := func(v float64) string {
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return name + ": " + format(points[len(points)-1].v) + " now, " + format(vmin) + " to " + format(vmax) +
+		"\n" + points[0].t.Format("2006-01-02 15:04") + " - " + points[len(points)-1].t.Format("2006-01-02 15:04")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendChart(t *testing.T) {
+	db := newMemoryStorage()
+	now := time.Now().Add(-time.Hour)
+	cell := &Record{Version: RECORD_VERSION, Kind: KIND_RANGE}
+	cell.SetRange("A", "1", "", "")
+	rng := &Record{Version: RECORD_VERSION, Kind: KIND_RANGE}
+	rng.SetRange("A", "1", "A", "2")
+	db.AddRecord(1, "cell", cell.Encode())
+	db.AddRecord(1, "range", rng.Encode())
+	for i, v := range []string{"1", "2"} {
+		db.AddHistory(1, "cell", HistoryEntry{now.Add(time.Duration(i) * time.Minute), v}, 10)
+	}
+	for i, v := range []string{"1\t2", "3\t4"} {
+		db.AddHistory(1, "range", HistoryEntry{now.Add(time.Duration(i) * time.Minute), v}, 10)
+	}
+	if reply := sendChart(db, 1, "cell"); reply != nil {
+		t.Errorf("reply to /chart cell = %q", reply.Text)
+	}
+	select {
+	case photo := <-photoChan:
+		if !strings.Contains(photo.Caption, "cell") {
+			t.Errorf("caption = %q", photo.Caption)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no chart was sent")
+	}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"range", "Charts can only be drawn for a single cell"},
+		{"nope", "No cell named nope"},
+	}
+	for _, test := range tests {
+		if reply := sendChart(db, 1, test.name); reply == nil || reply.Text != test.want {
+			t.Errorf("reply to /chart %s = %v, want %q", test.name, reply, test.want)
+		}
+	}
+	if len(photoChan) != 0 {
+		t.Error("a chart of a range was sent")
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// chatMessage is an incoming message together with what is known about its chat.
+type chatMessage struct {
+	// chat keys the records and the dialog state.
+	chat int64
+	user int
+	// group is set for group chats. There the bot only answers commands addressed to it,
+	// the menu buttons and the user who has started a dialog.
+	group bool
+	// id is the message to reply to, 0 if there is none.
+	id   int
+	text string
+}
+
+// chatAPI looks up chats and their members. It is set to the bot in main.
+var chatAPI interface {
+	GetChat(config tgbotapi.ChatConfig) (tgbotapi.Chat, error)
+	GetChatMember(config tgbotapi.ChatConfigWithUser) (tgbotapi.ChatMember, error)
+}
+
+// botUser is the account of the bot.
+var botUser tgbotapi.User
+
+// stripBotName removes "@botname" from a command. ok is false for commands addressed to other bots.
+func stripBotName(text string) (string, bool) {
+	if !strings.HasPrefix(text, "/") {
+		return text, true
+	}
+	command, rest := text, ""
+	if i := strings.Index(text, " "); i >= 0 {
+		command, rest = text[:i], text[i:]
+	}
+	if i := strings.Index(command, "@"); i >= 0 {
+		if !strings.EqualFold(command[i+1:], botUser.UserName) {
+			return "", false
+		}
+		command = command[:i]
+	}
+	return command + rest, true
+}
+
+// isChatAdmin reports whether the user administers the chat.
+func isChatAdmin(chat int64, user int) bool {
+	member, err := chatAPI.GetChatMember(tgbotapi.ChatConfigWithUser{ChatID: chat, UserID: user})
+	if err != nil {
+		log.Printf("Could not get member %d of %d: %s", user, chat, err.Error())
+		return false
+	}
+	return member.IsCreator() || member.IsAdministrator()
+}
+
+// resolveChannel finds the channel given by its @username or id. The user must administer
+// the channel and the bot must be able to post there.
+func resolveChannel(name string, user int) (*tgbotapi.Chat, error) {
+	config := tgbotapi.ChatConfig{SuperGroupUsername: name}
+	if !strings.HasPrefix(name, "@") {
+		id, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			return nil, errors.New("Send the channel as @username or as its id")
+		}
+		config = tgbotapi.ChatConfig{ChatID: id}
+	}
+	chat, err := chatAPI.GetChat(config)
+	if err != nil {
+		return nil, errors.New("Cannot find " + name + ", add me to it first")
+	}
+	if !isChatAdmin(chat.ID, user) {
+		return nil, errors.New("Only administrators of " + name + " can send notifications there")
+	}
+	if !isChatAdmin(chat.ID, botUser.ID) {
+		return nil, errors.New("Make me an administrator of " + name + " first")
+	}
+	return &chat, nil
+}
+
+// notifyTarget returns the chat that gets the notifications about the record.
+func notifyTarget(uid int64, rec *Record) int64 {
+	if id, err := strconv.ParseInt(rec.Options["notify"], 10, 64); err == nil {
+		return id
+	}
+	return uid
+}
+
+// reportInactiveTarget tells the owners of the records that notify the chat that their notifications
+// do not get there anymore. The chat stays inactive until /notify points to it again.
+func reportInactiveTarget(db Storage, chat int64) {
+	// Only groups and channels, which have negative ids, can be notified instead of the owner
+	if chat > 0 {
+		return
+	}
+	target := strconv.FormatInt(chat, 10)
+	for _, uid := range db.UserList() {
+		for _, pair := range db.RecordList(uid) {
+			rec, err := decodeRecord(pair.Value)
+			if err != nil || rec.Options["notify"] != target {
+				continue
+			}
+			channel, name := html.EscapeString(rec.Options["notifyname"]), html.EscapeString(pair.Name)
+			notifyUser(db, uid, "I cannot send the notifications about "+name+" to "+channel+" anymore. "+
+				"Make me an administrator there and use /notify "+channel+" "+name+" again, or /notify off "+name)
+		}
+	}
+}
+
+// replyInGroup shows the keyboard of the message only to the user it replies to.
+// Dialog steps get a forced reply instead, with their buttons listed in the text,
+// because bots in groups do not see other messages, including the button presses.
+// Messages to private chats are left as they are.
+func replyInGroup(msg *tgbotapi.MessageConfig, group bool, replyTo int) {
+	if msg == nil || !group {
+		return
+	}
+	msg.ReplyToMessageID = replyTo
+	selective := replyTo != 0
+	switch kb := msg.ReplyMarkup.(type) {
+	case tgbotapi.ReplyKeyboardMarkup:
+		var options []string
+		for _, row := range kb.Keyboard {
+			for _, button := range row {
+				options = append(options, button.Text)
+			}
+		}
+		if len(options) > 0 && options[0] == "Cancel" {
+			if len(options) > 1 {
+				msg.Text += "\n\nReply with your answer or one of: " + strings.Join(options, ", ")
+			}
+			msg.ReplyMarkup = tgbotapi.ForceReply{ForceReply: true, Selective: selective}
+			return
+		}
+		kb.Selective = selective
+		msg.ReplyMarkup = kb
+	case tgbotapi.ReplyKeyboardHide:
+		kb.Selective = selective
+		msg.ReplyMarkup = kb
+	}
+}
+
+// mayInterrupt reports whether the message may change the dialog state of the chat.
+// In groups, a dialog in progress belongs to the user who started it, and only
+// that user and the administrators may cancel it or start another one.
+func mayInterrupt(ustate map[string]string, m *chatMessage) bool {
+	if !m.group || ustate["name"] == "" || ustate["user"] == strconv.Itoa(m.user) {
+		return true
+	}
+	return isChatAdmin(m.chat, m.user)
+}
+
+func copyState(ustate map[string]string) map[string]string {
+	res := make(map[string]string, len(ustate))
+	for k, v := range ustate {
+		res[k] = v
+	}
+	return res
+}
+
+// stateReply returns the group flag and the message to reply to saved in the dialog state.
+func stateReply(ustate map[string]string) (bool, int) {
+	replyTo, _ := strconv.Atoi(ustate["reply"])
+	return ustate["group"] != "", replyTo
+}
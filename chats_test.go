@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// fakeChats knows the channel @news (-100) and treats the users in admins as administrators of every chat.
+type fakeChats struct {
+	admins map[int]bool
+}
+
+func (f fakeChats) GetChat(c tgbotapi.ChatConfig) (tgbotapi.Chat, error) {
+	if c.SuperGroupUsername == "@news" || c.ChatID == -100 {
+		return tgbotapi.Chat{ID: -100, Type: "channel"}, nil
+	}
+	return tgbotapi.Chat{}, errors.New("Bad Request: chat not found")
+}
+
+func (f fakeChats) GetChatMember(c tgbotapi.ChatConfigWithUser) (tgbotapi.ChatMember, error) {
+	if f.admins[c.UserID] {
+		return tgbotapi.ChatMember{Status: "administrator"}, nil
+	}
+	return tgbotapi.ChatMember{Status: "member"}, nil
+}
+
+// useChats replaces the chat lookups and the bot account for the duration of the test.
+func useChats(t *testing.T, admins ...int) {
+	oldAPI, oldUser := chatAPI, botUser
+	f := fakeChats{admins: map[int]bool{99: true}}
+	for _, id := range admins {
+		f.admins[id] = true
+	}
+	chatAPI, botUser = f, tgbotapi.User{ID: 99, UserName: "MonBot"}
+	t.Cleanup(func() {
+		chatAPI, botUser = oldAPI, oldUser
+	})
+}
+
+func TestGroupDialogOwner(t *testing.T) {
+	useChats(t, 7, 8)
+	db := newMemoryStorage()
+	send := func(user int, text string) *tgbotapi.MessageConfig {
+		return handle(db, &chatMessage{chat: -5, user: user, group: true, id: 10, text: text})
+	}
+	if reply := send(7, "Add a cell"); reply == nil || !strings.HasPrefix(reply.Text, "Enter the cell URL") {
+		t.Fatalf("reply to the admin = %v", reply)
+	}
+	if reply := send(1, "hello"); reply != nil {
+		t.Errorf("reply to a message not meant for the bot = %q", reply.Text)
+	}
+	for _, command := range []string{"/help@MonBot", "/start", "/history x", "/unknown"} {
+		send(1, command)
+		if st := db.GetState(-5); st["name"] != "add" || st["user"] != "7" || st["reply"] != "10" {
+			t.Errorf("state after %s from a member = %v", command, st)
+		}
+	}
+	if reply := handleCallback(db, &chatMessage{chat: -5, user: 1, group: true, text: "Delete"}); reply == nil {
+		t.Error("no reply to the callback of a member")
+	}
+	if st := db.GetState(-5); st["name"] != "add" || st["user"] != "7" {
+		t.Errorf("state after a callback from a member = %v", st)
+	}
+	send(8, "/start")
+	if st := db.GetState(-5); st["name"] != "" {
+		t.Errorf("another admin could not cancel the dialog: %v", st)
+	}
+}
+
+func TestStripBotName(t *testing.T) {
+	useChats(t)
+	tests := []struct {
+		in, out string
+		ok      bool
+	}{
+		{"/help", "/help", true},
+		{"/help@monbot", "/help", true},
+		{"/history@MonBot x y", "/history x y", true},
+		{"/help@OtherBot", "", false},
+		{"plain text", "plain text", true},
+	}
+	for _, tt := range tests {
+		if out, ok := stripBotName(tt.in); out != tt.out || ok != tt.ok {
+			t.Errorf("stripBotName(%q) = %q, %v", tt.in, out, ok)
+		}
+	}
+}
+
+func TestReplyInGroup(t *testing.T) {
+	msg := makeMessage(-5, "What cell?", mainDialog.steps["add-cell"].keyboard)
+	replyInGroup(msg, true, 10)
+	if _, ok := msg.ReplyMarkup.(tgbotapi.ForceReply); !ok || msg.ReplyToMessageID != 10 ||
+		!strings.HasSuffix(msg.Text, "one of: Cancel, "+TABS_STR+", "+TABLE_STR+", "+LOOKUP_STR) {
+		t.Errorf("dialog step = %q, %#v", msg.Text, msg.ReplyMarkup)
+	}
+	msg = makeMessage(-5, "Ok", MENU_KB)
+	replyInGroup(msg, true, 10)
+	if kb, ok := msg.ReplyMarkup.(tgbotapi.ReplyKeyboardMarkup); !ok || !kb.Selective || msg.Text != "Ok" {
+		t.Errorf("menu = %q, %#v", msg.Text, msg.ReplyMarkup)
+	}
+	msg = makeMessage(1, "Ok", []string{"Cancel"})
+	replyInGroup(msg, false, 10)
+	if _, ok := msg.ReplyMarkup.(tgbotapi.ReplyKeyboardMarkup); !ok || msg.ReplyToMessageID != 0 {
+		t.Errorf("private message = %#v", msg)
+	}
+}
+
+func TestGroupTypedButtons(t *testing.T) {
+	useChats(t, 7)
+	db := newMemoryStorage()
+	send := func(text string) *tgbotapi.MessageConfig {
+		return handle(db, &chatMessage{chat: -5, user: 7, group: true, id: 10, text: text})
+	}
+	if reply := send("/add@MonBot"); reply == nil || !strings.HasPrefix(reply.Text, "Enter the cell URL") {
+		t.Fatalf("reply to /add = %v", reply)
+	}
+	if reply := send("cancel"); reply == nil || reply.Text != "Ok" {
+		t.Errorf("reply to a typed Cancel = %v", reply)
+	}
+	if reply := send("/list"); reply == nil || reply.Text != "You have no cells yet" {
+		t.Errorf("reply to /list = %v", reply)
+	}
+}
+
+func TestInactiveNotifyTarget(t *testing.T) {
+	useChats(t, 7)
+	bot, _ := testBot(t, map[int64]string{
+		-100: `{"ok":false,"error_code":403,"description":"Forbidden: bot is not a member of the channel chat"}`,
+	})
+	db := newMemoryStorage()
+	db.AddRecord(1, "kpi", (&Record{Version: RECORD_VERSION, Kind: KIND_TABS}).Encode())
+	if reply := setNotify(db, 1, 7, "@news kpi"); reply != "Ok" {
+		t.Fatalf("setNotify = %q", reply)
+	}
+	sendMessage(bot, db, -100, tgbotapi.NewMessage(-100, "x"))
+	if !db.IsInactive(-100) {
+		t.Fatal("the channel is not marked inactive")
+	}
+	outbox := db.Outbox()
+	if len(outbox) != 1 || outbox[0].Chat != 1 || !strings.HasPrefix(outbox[0].Text, "I cannot send the notifications about kpi to @news") {
+		t.Errorf("outbox = %v, want a message to the owner", outbox)
+	}
+	if reply := setNotify(db, 1, 7, "@news kpi"); reply != "Ok" || db.IsInactive(-100) {
+		t.Errorf("setNotify = %q, the channel is inactive: %v", reply, db.IsInactive(-100))
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	COND_ANY         = "any"
+	COND_GREATER     = ">"
+	COND_LESS        = "<"
+	COND_CROSS_ABOVE = "above"
+	COND_CROSS_BELOW = "below"
+	COND_MATCHES     = "matches"
+	COND_EMPTY       = "empty"
+	COND_PERCENT     = "%"
+)
+
+const CONDITION_HELP = `When should I notify you?
+any - on any change
+> 100 - when the value changes and is greater than 100
+< 100 - when the value changes and is less than 100
+above 100 - when the value crosses above 100
+below 100 - when the value crosses below 100
+matches <regexp> - when the new value matches the regular expression
+empty - when the value becomes empty
+% 10 - when the value changes by more than 10%`
+
+// RANGE_CONDITION_HELP lists the conditions for records whose value is not a single number.
+const RANGE_CONDITION_HELP = `When should I notify you?
+any - on any change
+matches <regexp> - when the new value matches the regular expression
+empty - when the value becomes empty`
+
+// Condition decides whether a change of a cell is worth a notification.
+type Condition struct {
+	Op     string
+	Number float64
+	Regexp *regexp.Regexp
+}
+
+var NUMBER_JUNK_RE = regexp.MustCompile(`[^0-9.,\-+eE]`)
+
+// THOUSANDS_RE matches integers with commas between groups of three digits, like 1,234,567.
+var THOUSANDS_RE = regexp.MustCompile(`^[-+]?\d{1,3}(,\d{3})+$`)
+
+// parseNumber reads a number the way spreadsheets display it, ignoring currency signs,
+// percent signs, spaces and thousands separators. A comma followed by three digits
+// separates thousands, other commas are decimal separators, as in 1,5 or 1.234,5.
+// Tabs and line breaks separate the cells of a range, so such text is not a number.
+func parseNumber(s string) (float64, bool) {
+	if strings.ContainsAny(s, "\t\n") {
+		return 0, false
+	}
+	s = NUMBER_JUNK_RE.ReplaceAllString(s, "")
+	dot, comma := strings.LastIndex(s, "."), strings.LastIndex(s, ",")
+	switch {
+	case comma < 0:
+	case dot > comma || THOUSANDS_RE.MatchString(s):
+		s = strings.Replace(s, ",", "", -1)
+	case dot >= 0:
+		s = strings.Replace(strings.Replace(s, ".", "", -1), ",", ".", 1)
+	default:
+		s = strings.Replace(s, ",", ".", 1)
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	return n, err == nil
+}
+
+// parseCondition reads a condition in the format described in CONDITION_HELP.
+func parseCondition(s string) (*Condition, error) {
+	s = strings.Trim(s, " ")
+	if s == "" || strings.ToLower(s) == COND_ANY || s == "Any change" {
+		return &Condition{Op: COND_ANY}, nil
+	}
+	if strings.ToLower(s) == COND_EMPTY {
+		return &Condition{Op: COND_EMPTY}, nil
+	}
+	if strings.HasPrefix(strings.ToLower(s), COND_MATCHES+" ") {
+		re, err := regexp.Compile(strings.Trim(s[len(COND_MATCHES)+1:], " "))
+		if err != nil {
+			return nil, errors.New("Bad regular expression: " + err.Error())
+		}
+		return &Condition{Op: COND_MATCHES, Regexp: re}, nil
+	}
+	for _, op := range []string{COND_GREATER, COND_LESS, COND_CROSS_ABOVE, COND_CROSS_BELOW, COND_PERCENT} {
+		if !strings.HasPrefix(strings.ToLower(s), op) {
+			continue
+		}
+		n, err := strconv.ParseFloat(strings.Trim(s[len(op):], " "), 64)
+		if err != nil {
+			return nil, errors.New("Bad number in the condition")
+		}
+		return &Condition{Op: op, Number: n}, nil
+	}
+	return nil, errors.New("Unknown condition")
+}
+
+// conditions keeps the parsed conditions by their text, so that regular expressions
+// are not compiled again on every check.
+var conditions = struct {
+	sync.Mutex
+	m map[string]*Condition
+}{m: make(map[string]*Condition)}
+
+// CONDITIONS_MAX_CACHED limits the number of parsed conditions kept. The cache is
+// dropped when it is full, so conditions of deleted records do not pile up.
+const CONDITIONS_MAX_CACHED = 1000
+
+// recordCondition returns the condition stored in the record. Records without one,
+// with a broken one or with a numeric one on a value that is not a number notify on any change.
+func recordCondition(rec *Record) *Condition {
+	cond := cachedCondition(rec.Options["condition"])
+	if cond.IsNumeric() && !rec.HasNumber() {
+		return &Condition{Op: COND_ANY}
+	}
+	return cond
+}
+
+func cachedCondition(text string) *Condition {
+	conditions.Lock()
+	defer conditions.Unlock()
+	if cond, ok := conditions.m[text]; ok {
+		return cond
+	}
+	cond, err := parseCondition(text)
+	if err != nil {
+		cond = &Condition{Op: COND_ANY}
+	}
+	if len(conditions.m) >= CONDITIONS_MAX_CACHED {
+		conditions.m = make(map[string]*Condition)
+	}
+	conditions.m[text] = cond
+	return cond
+}
+
+// IsNumeric reports whether the condition compares numbers.
+func (c *Condition) IsNumeric() bool {
+	return c.Op != COND_ANY && c.Op != COND_EMPTY && c.Op != COND_MATCHES
+}
+
+func (c *Condition) String() string {
+	switch c.Op {
+	case COND_ANY, COND_EMPTY:
+		return c.Op
+	case COND_MATCHES:
+		return COND_MATCHES + " " + c.Regexp.String()
+	}
+	return c.Op + " " + strconv.FormatFloat(c.Number, 'g', -1, 64)
+}
+
+// Match reports whether the change from old to new should be notified about.
+// It is only called for values that differ.
+func (c *Condition) Match(old string, new string) bool {
+	switch c.Op {
+	case COND_ANY:
+		return true
+	case COND_EMPTY:
+		return old != "" && strings.Trim(new, " ") == ""
+	case COND_MATCHES:
+		return c.Regexp.MatchString(new)
+	}
+	n, ok := parseNumber(new)
+	if !ok {
+		return false
+	}
+	switch c.Op {
+	case COND_GREATER:
+		return n > c.Number
+	case COND_LESS:
+		return n < c.Number
+	}
+	o, ok := parseNumber(old)
+	if !ok {
+		return false
+	}
+	switch c.Op {
+	case COND_CROSS_ABOVE:
+		return o <= c.Number && n > c.Number
+	case COND_CROSS_BELOW:
+		return o >= c.Number && n < c.Number
+	case COND_PERCENT:
+		if o == 0 {
+			return n != 0
+		}
+		return math.Abs(n-o)/math.Abs(o)*100 > c.Number
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package main
+
+import "testing"
+
+func TestParseNumber(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+		ok   bool
+	}{
+		{"42", 42, true},
+		{"-3.5", -3.5, true},
+		{"$1,234", 1234, true},
+		{"1,234,567", 1234567, true},
+		{"1,234.56", 1234.56, true},
+		{"1.234,56", 1234.56, true},
+		{"1,5", 1.5, true},
+		{"3,14159", 3.14159, true},
+		{"12,5 %", 12.5, true},
+		{"€ 1 000", 1000, true},
+		{"1e3", 1000, true},
+		{"1,2,3", 0, false},
+		{"1\t2", 0, false},
+		{"100\n5", 0, false},
+		{"1.2.3", 0, false},
+		{"", 0, false},
+		{"n/a", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseNumber(tt.in)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("parseNumber(%q) = %v, %v, want %v, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestConditionMatch(t *testing.T) {
+	tests := []struct {
+		cond     string
+		old, new string
+		want     bool
+	}{
+		{"any", "1", "2", true},
+		{"> 1000", "900", "1,234", true},
+		{"> 1000", "900", "999", false},
+		{"< 10", "20", "9,5", true},
+		{"above 100", "99", "101", true},
+		{"above 100", "101", "102", false},
+		{"below 100", "101", "99", true},
+		{"% 10", "100", "109", false},
+		{"% 10", "100", "111", true},
+		{"% 10", "0", "1", true},
+		{"empty", "x", " ", true},
+		{"empty", "", " ", false},
+		{"matches ^ok", "no", "ok now", true},
+		{"matches ^ok", "no", "not ok", false},
+		{"> 5", "1", "text", false},
+	}
+	for _, tt := range tests {
+		cond, err := parseCondition(tt.cond)
+		if err != nil {
+			t.Errorf("parseCondition(%q): %v", tt.cond, err)
+			continue
+		}
+		if got := cond.Match(tt.old, tt.new); got != tt.want {
+			t.Errorf("%q.Match(%q, %q) = %v, want %v", tt.cond, tt.old, tt.new, got, tt.want)
+		}
+	}
+	for _, bad := range []string{"> x", "matches (", "sometimes"} {
+		if _, err := parseCondition(bad); err == nil {
+			t.Errorf("parseCondition(%q) accepted", bad)
+		}
+	}
+}
+
+func TestRecordConditionCached(t *testing.T) {
+	rec := &Record{Options: map[string]string{"condition": "matches ^a+$"}}
+	first := recordCondition(rec)
+	if first.Op != COND_MATCHES || recordCondition(rec) != first {
+		t.Error("the condition is parsed again")
+	}
+	broken := &Record{Options: map[string]string{"condition": "matches ("}}
+	if cond := recordCondition(broken); cond.Op != COND_ANY {
+		t.Errorf("broken condition = %v, want any", cond)
+	}
+}
+
+func TestRecordConditionOfRange(t *testing.T) {
+	rng := &Record{Version: RECORD_VERSION, Kind: KIND_RANGE, Options: map[string]string{"condition": "> 100"}}
+	rng.SetRange("A", "1", "A", "2")
+	if cond := recordCondition(rng); cond.Op != COND_ANY {
+		t.Errorf("condition of a range = %v, want any", cond)
+	}
+	cell := &Record{Version: RECORD_VERSION, Kind: KIND_RANGE, Options: map[string]string{"condition": "> 100"}}
+	cell.SetRange("A", "1", "", "")
+	if cond := recordCondition(cell); cond.Op != COND_GREATER {
+		t.Errorf("condition of a cell = %v", cond)
+	}
+}
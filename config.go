@@ -1,15 +1,68 @@
 package main
 
-import "flag"
+import (
+	"flag"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
 
 var configMap = make(map[string]string)
 
 func init() {
-	token := flag.String("token", "", "token for telegram")
-	addr := flag.String("addr", "localhost:6379", "redis address")
-	passwd := flag.String("passwd", "", "redis password")
-	flag.Parse()
-	configMap["token"] = *token
-	configMap["addr"] = *addr
-	configMap["passwd"] = *passwd
+	flag.String("token", "", "token for telegram")
+	flag.String("addr", "localhost:6379", "redis address")
+	flag.String("passwd", "", "redis password")
+	flag.String("storage", "redis", "storage backend: redis, bolt or memory")
+	flag.String("dbpath", "spreadmon.db", "database file for the bolt storage")
+	flag.Duration("statettl", 24*time.Hour, "how long an abandoned dialog is kept")
+	flag.Duration("interval", 30*time.Second, "how often the cells are checked")
+	flag.Int("workers", 8, "number of spreadsheets checked in parallel")
+	flag.Duration("cachettl", 20*time.Second, "how long a fetched spreadsheet is used before it is revalidated")
+	flag.String("fetch", "auto", "how cells are fetched: html, csv, api or auto to fall back from html to csv and api")
+	flag.String("apikey", "", "Google API key for reading sheets through the Sheets API")
+	flag.String("credentials", "", "service account key file for reading private sheets through the Sheets API")
+	flag.String("sheetsapi", "https://sheets.googleapis.com", "base URL of the Sheets API")
+	flag.Int("fetches", 4, "maximum number of concurrent requests to Google")
+	flag.Duration("timeout", 20*time.Second, "timeout of a single request to Google")
+	flag.String("proxy", "", "proxy URL for requests to Google, the environment is used if empty")
+	flag.String("useragent", "spreadmon", "User-Agent of requests to Google")
+	flag.String("baseurl", "https://docs.google.com/spreadsheets/", "base URL of the spreadsheets")
+	flag.Int("history", 100, "number of values kept in the history of every cell, 0 to keep none")
+	flag.Bool("migrate", false, "copy all records from redis into the bolt database file and exit")
+	flag.String("webhook", "", "public URL of the webhook, long polling is used if empty")
+	flag.String("listen", ":8443", "address the webhook server listens on")
+	flag.String("cert", "", "TLS certificate of the webhook server, plain HTTP behind a reverse proxy is served if empty")
+	flag.String("key", "", "TLS key of the webhook server")
+	flag.String("secret", "", "secret token Telegram sends with every webhook request, a random one is used if empty")
+	// The defaults are loaded here, so that configMap is usable before main parses the command line
+	loadConfig()
+}
+
+// loadConfig copies the values of the flags into configMap.
+func loadConfig() {
+	flag.VisitAll(func(f *flag.Flag) {
+		configMap[f.Name] = f.Value.String()
+	})
+	// The paths of the documents are appended to the base URL
+	if !strings.HasSuffix(configMap["baseurl"], "/") {
+		configMap["baseurl"] += "/"
+	}
+}
+
+func configDuration(name string) time.Duration {
+	d, err := time.ParseDuration(configMap[name])
+	if err != nil {
+		log.Panic("Bad duration in -" + name + ": " + configMap[name])
+	}
+	return d
+}
+
+func configInt(name string) int {
+	n, err := strconv.Atoi(configMap[name])
+	if err != nil {
+		log.Panic("Bad number in -" + name + ": " + configMap[name])
+	}
+	return n
 }
@@ -1,16 +1,89 @@
 package main
 
 import (
-	"encoding/json"
 	"log"
 	"sort"
-	"strconv"
-	"sync"
-
-	"github.com/go-redis/redis"
+	"time"
 )
 
-var database *redis.Client
+// Storage keeps the monitored records of every user and the last seen values of their cells.
+type Storage interface {
+	RecordExists(uid int64, name string) bool
+	GetRecord(uid int64, name string) (string, bool)
+	AddRecord(uid int64, name string, record string)
+	RecordList(uid int64) StringPairs
+	DeleteRecord(uid int64, name string)
+	UserList() []int64
+	GetCellVal(uid int64, name string) (string, bool)
+	// UpdateCellVal stores the new value and returns the previous one.
+	// If there was no previous value, the new one is returned.
+	UpdateCellVal(uid int64, name string, value string) string
+	DeleteCellVal(uid int64, name string)
+	// AddHistory appends a value to the history of the record, keeping at most limit latest values.
+	// A limit of 0 or less keeps no history at all.
+	AddHistory(uid int64, name string, entry HistoryEntry, limit int)
+	// History returns the stored values of the record, oldest first.
+	History(uid int64, name string) []HistoryEntry
+	DeleteHistory(uid int64, name string)
+	// GetState returns the dialog state of the user, or an empty map if there is none or it has expired.
+	GetState(uid int64) map[string]string
+	// SetState replaces the dialog state of the user. An empty state is deleted.
+	SetState(uid int64, state map[string]string, ttl time.Duration)
+	// AddShare stores the record an invite code points to.
+	AddShare(code string, rec RecordRef)
+	GetShare(code string) (RecordRef, bool)
+	DeleteShare(code string)
+	// Subscribe makes the chat sub receive the notifications about a record of another chat.
+	Subscribe(sub int64, rec RecordRef)
+	Unsubscribe(sub int64, rec RecordRef)
+	// Subscribers returns the chats subscribed to the record.
+	Subscribers(rec RecordRef) []int64
+	// Subscriptions returns the records the chat is subscribed to.
+	Subscriptions(sub int64) []RecordRef
+	// AddOutbox keeps a notification until it is delivered.
+	AddOutbox(msg OutboxMessage)
+	// Outbox returns the undelivered notifications ordered by their ids.
+	Outbox() []OutboxMessage
+	DeleteOutbox(id string)
+	// SetInactive marks a chat that has blocked the bot, or clears the mark.
+	SetInactive(chat int64, inactive bool)
+	IsInactive(chat int64) bool
+}
+
+// OutboxMessage is a notification waiting to be sent.
+type OutboxMessage struct {
+	// ID orders the notifications by the time they were created.
+	ID      string    `json:"id"`
+	Chat    int64     `json:"chat"`
+	Text    string    `json:"text"`
+	Created time.Time `json:"created"`
+}
+
+type outboxMessages []OutboxMessage
+
+func (s outboxMessages) Len() int {
+	return len(s)
+}
+
+func (s outboxMessages) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s outboxMessages) Less(i, j int) bool {
+	return s[i].ID < s[j].ID
+}
+
+// RecordRef points to a record of a user.
+type RecordRef struct {
+	Uid  int64  `json:"uid"`
+	Name string `json:"name"`
+}
+
+// HistoryEntry is a value a cell had since the given time.
+type HistoryEntry struct {
+	Time  time.Time `json:"time"`
+	Value string    `json:"value"`
+}
 
 type StringPair struct {
 	Name  string
@@ -31,103 +104,67 @@ func (s StringPairs) Less(i, j int) bool {
 	return s[i].Name < s[j].Name
 }
 
-func connect() {
-	database = redis.NewClient(&redis.Options{Addr: configMap["addr"], Password: configMap["passwd"], DB: 0})
-	_, err := database.Ping().Result()
-	if err != nil {
-		log.Panic(err.Error())
-	}
-}
-
-func recordExists(uid int64, name string) bool {
-	_, err := database.HGet("records/"+strconv.FormatInt(uid, 10), name).Result()
-	return err == nil
-}
-
-func addRecord(uid int64, name string, record string) {
-	database.HSet("records/"+strconv.FormatInt(uid, 10), name, record)
-}
-
-func parseList(l string) []string {
-	var s []string
-	json.Unmarshal([]byte(l), &s)
-	return s
-}
-
-func recordList(uid int64) StringPairs {
-	res := make(StringPairs, 0)
-	for name, value := range database.HGetAll("records/" + strconv.FormatInt(uid, 10)).Val() {
+func sortedPairs(m map[string]string) StringPairs {
+	res := make(StringPairs, 0, len(m))
+	for name, value := range m {
 		res = append(res, StringPair{name, value})
 	}
 	sort.Sort(res)
 	return res
 }
 
-func deleteRecord(uid int64, name string) {
-	database.HDel("records/"+strconv.FormatInt(uid, 10), name)
-}
-
-var tableCache = make(map[string]string)
-
-var tableLock = sync.Mutex{}
-
-func getTable(name string) *string {
-	tableLock.Lock()
-	defer tableLock.Unlock()
-	data, ok := tableCache[name]
-	if ok {
-		return &data
-	}
-	pdata := fetchTable(name)
-	if pdata != nil {
-		tableCache[name] = *pdata
-	}
-	return pdata
-}
-
-func clearTableCache() {
-	tableLock.Lock()
-	for i := range tableCache {
-		delete(tableCache, i)
+func openStorage() Storage {
+	switch configMap["storage"] {
+	case "redis":
+		return newRedisStorage(configMap["addr"], configMap["passwd"])
+	case "bolt":
+		return newBoltStorage(configMap["dbpath"])
+	case "memory":
+		return newMemoryStorage()
 	}
-	tableLock.Unlock()
-}
-
-func userList() []int64 {
-	l := database.Keys("records/*").Val()
-	res := make([]int64, len(l))
-	for i, v := range l {
-		res[i], _ = strconv.ParseInt(v[8:], 10, 64)
+	log.Panic("Unknown storage: " + configMap["storage"])
+	return nil
+}
+
+// migrateStorage copies every record, the last seen value of its cell, its history and its subscribers
+// from src to dst, together with the undelivered notifications.
+func migrateStorage(src Storage, dst Storage) (users int, records int) {
+	chats := make(map[int64]bool)
+	for _, uid := range src.UserList() {
+		users++
+		chats[uid] = true
+		for _, v := range src.RecordList(uid) {
+			records++
+			dst.AddRecord(uid, v.Name, v.Value)
+			if val, ok := src.GetCellVal(uid, v.Name); ok {
+				dst.UpdateCellVal(uid, v.Name, val)
+			}
+			history := src.History(uid, v.Name)
+			for _, entry := range history {
+				dst.AddHistory(uid, v.Name, entry, len(history))
+			}
+			ref := RecordRef{uid, v.Name}
+			if rec, err := decodeRecord(v.Value); err == nil {
+				chats[notifyTarget(uid, rec)] = true
+				if rec.Options["share"] != "" {
+					if share, ok := src.GetShare(rec.Options["share"]); ok {
+						dst.AddShare(rec.Options["share"], share)
+					}
+				}
+			}
+			for _, sub := range src.Subscribers(ref) {
+				chats[sub] = true
+				dst.Subscribe(sub, ref)
+			}
+		}
 	}
-	return res
-}
-
-var cellLock = sync.Mutex{}
-
-func getCellVal(uid int64, name string) (string, bool) {
-	val, err := database.HGet("cells/"+strconv.FormatInt(uid, 10), name).Result()
-	if err == nil {
-		return val, true
-	} else {
-		return "", false
+	for _, msg := range src.Outbox() {
+		dst.AddOutbox(msg)
 	}
-}
-
-func updateCellVal(uid int64, name string, value string) string {
-	cellLock.Lock()
-	defer cellLock.Unlock()
-	old, err := database.HGet("cells/"+strconv.FormatInt(uid, 10), name).Result()
-	if err != nil || old != value {
-		database.HSet("cells/"+strconv.FormatInt(uid, 10), name, value)
-		if err != nil {
-			return value
+	for chat := range chats {
+		if src.IsInactive(chat) {
+			dst.SetInactive(chat, true)
 		}
 	}
-	return old
-}
-
-func deleteCellVal(uid int64, name string) {
-	cellLock.Lock()
-	database.HDel("cells/"+strconv.FormatInt(uid, 10), name)
-	cellLock.Unlock()
+	return
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// storages returns a fresh instance of every backend that does not need a server.
+func storages(t *testing.T) map[string]Storage {
+	return map[string]Storage{
+		"memory": newMemoryStorage(),
+		"bolt":   newBoltStorage(filepath.Join(t.TempDir(), "test.db")),
+	}
+}
+
+func TestStorageRecords(t *testing.T) {
+	for backend, db := range storages(t) {
+		db.AddRecord(1, "b", "rec b")
+		db.AddRecord(1, "a", "rec a")
+		db.AddRecord(2, "c", "rec c")
+		if !db.RecordExists(1, "a") || db.RecordExists(1, "c") {
+			t.Errorf("%s: RecordExists is wrong", backend)
+		}
+		if v, ok := db.GetRecord(2, "c"); !ok || v != "rec c" {
+			t.Errorf("%s: GetRecord(2, c) = %q, %v", backend, v, ok)
+		}
+		want := StringPairs{{"a", "rec a"}, {"b", "rec b"}}
+		if got := db.RecordList(1); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: RecordList(1) = %v, want %v", backend, got, want)
+		}
+		db.DeleteRecord(2, "c")
+		if users := db.UserList(); len(users) != 1 || users[0] != 1 {
+			t.Errorf("%s: UserList() = %v, want [1]", backend, users)
+		}
+	}
+}
+
+func TestStorageCellValues(t *testing.T) {
+	for backend, db := range storages(t) {
+		if _, ok := db.GetCellVal(1, "a"); ok {
+			t.Errorf("%s: value of a new cell is found", backend)
+		}
+		if old := db.UpdateCellVal(1, "a", "x"); old != "x" {
+			t.Errorf("%s: first UpdateCellVal returned %q, want the new value", backend, old)
+		}
+		if old := db.UpdateCellVal(1, "a", "y"); old != "x" {
+			t.Errorf("%s: UpdateCellVal returned %q, want x", backend, old)
+		}
+		db.DeleteCellVal(1, "a")
+		if _, ok := db.GetCellVal(1, "a"); ok {
+			t.Errorf("%s: deleted value is found", backend)
+		}
+	}
+}
+
+func TestStorageHistory(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	for backend, db := range storages(t) {
+		for i, v := range []string{"1", "2", "3"} {
+			db.AddHistory(1, "a", HistoryEntry{now.Add(time.Duration(i) * time.Minute), v}, 2)
+		}
+		h := db.History(1, "a")
+		if len(h) != 2 || h[0].Value != "2" || h[1].Value != "3" || !h[1].Time.Equal(now.Add(2*time.Minute)) {
+			t.Errorf("%s: History = %v, want the last two values", backend, h)
+		}
+		db.DeleteHistory(1, "a")
+		if h := db.History(1, "a"); len(h) != 0 {
+			t.Errorf("%s: deleted history = %v", backend, h)
+		}
+		db.AddHistory(1, "b", HistoryEntry{now, "1"}, 2)
+		db.AddHistory(1, "b", HistoryEntry{now, "2"}, 0)
+		if h := db.History(1, "b"); len(h) != 0 {
+			t.Errorf("%s: history with limit 0 = %v, want none", backend, h)
+		}
+	}
+}
+
+func TestStorageState(t *testing.T) {
+	for backend, db := range storages(t) {
+		db.SetState(1, map[string]string{"name": "add"}, time.Hour)
+		db.SetState(2, map[string]string{"name": "add"}, -time.Second)
+		if st := db.GetState(1); st["name"] != "add" {
+			t.Errorf("%s: GetState(1) = %v", backend, st)
+		}
+		if st := db.GetState(2); len(st) != 0 {
+			t.Errorf("%s: expired state = %v", backend, st)
+		}
+		db.SetState(1, nil, 0)
+		if st := db.GetState(1); st == nil || len(st) != 0 {
+			t.Errorf("%s: deleted state = %v, want an empty map", backend, st)
+		}
+	}
+}
+
+func TestMigrateStorage(t *testing.T) {
+	src := newMemoryStorage()
+	src.AddRecord(1, "a", "rec a")
+	src.AddRecord(1, "b", "rec b")
+	src.AddRecord(2, "c", "rec c")
+	src.UpdateCellVal(1, "a", "x")
+	src.AddHistory(1, "a", HistoryEntry{time.Now().UTC(), "x"}, 10)
+	dst := newBoltStorage(filepath.Join(t.TempDir(), "test.db"))
+	users, records := migrateStorage(src, dst)
+	if users != 2 || records != 3 {
+		t.Errorf("migrated %d users and %d records, want 2 and 3", users, records)
+	}
+	if v, ok := dst.GetCellVal(1, "a"); !ok || v != "x" {
+		t.Errorf("migrated value = %q, %v", v, ok)
+	}
+	if h := dst.History(1, "a"); len(h) != 1 {
+		t.Errorf("migrated history = %v", h)
+	}
+	if !reflect.DeepEqual(src.RecordList(2), dst.RecordList(2)) {
+		t.Errorf("migrated records = %v", dst.RecordList(2))
+	}
+}
+
+func TestStorageSubscribersConcurrent(t *testing.T) {
+	for backend, db := range storages(t) {
+		ref := RecordRef{1, "kpi"}
+		var wg sync.WaitGroup
+		for sub := int64(2); sub < 22; sub++ {
+			wg.Add(1)
+			go func(sub int64) {
+				defer wg.Done()
+				db.Subscribe(sub, ref)
+			}(sub)
+		}
+		wg.Wait()
+		if subs := db.Subscribers(ref); len(subs) != 20 {
+			t.Errorf("%s: %d subscribers, want 20", backend, len(subs))
+		}
+		for sub := int64(2); sub < 22; sub += 2 {
+			wg.Add(1)
+			go func(sub int64) {
+				defer wg.Done()
+				db.Unsubscribe(sub, ref)
+			}(sub)
+		}
+		wg.Wait()
+		if subs := db.Subscribers(ref); len(subs) != 10 {
+			t.Errorf("%s: %d subscribers left, want 10", backend, len(subs))
+		}
+		if refs := db.Subscriptions(3); len(refs) != 1 || refs[0] != ref {
+			t.Errorf("%s: Subscriptions(3) = %v", backend, refs)
+		}
+		if refs := db.Subscriptions(2); len(refs) != 0 {
+			t.Errorf("%s: Subscriptions(2) = %v", backend, refs)
+		}
+	}
+}
+
+func TestStorageOutbox(t *testing.T) {
+	created := time.Now().UTC().Truncate(time.Second)
+	ids := []string{newOutboxID(), newOutboxID(), newOutboxID()}
+	for backend, db := range storages(t) {
+		// Added out of order, delivered in the order of the ids
+		for _, i := range []int{2, 0, 1} {
+			db.AddOutbox(OutboxMessage{ID: ids[i], Chat: int64(i), Text: "msg " + ids[i], Created: created})
+		}
+		outbox := db.Outbox()
+		if len(outbox) != 3 {
+			t.Fatalf("%s: outbox = %v", backend, outbox)
+		}
+		for i, m := range outbox {
+			if m.ID != ids[i] || m.Chat != int64(i) || m.Text != "msg "+ids[i] || !m.Created.Equal(created) {
+				t.Errorf("%s: outbox[%d] = %+v", backend, i, m)
+			}
+		}
+		db.DeleteOutbox(ids[1])
+		if outbox := db.Outbox(); len(outbox) != 2 || outbox[0].ID != ids[0] || outbox[1].ID != ids[2] {
+			t.Errorf("%s: outbox after delete = %v", backend, outbox)
+		}
+	}
+}
+
+func TestStorageInactive(t *testing.T) {
+	for backend, db := range storages(t) {
+		if db.IsInactive(5) {
+			t.Errorf("%s: a new chat is inactive", backend)
+		}
+		db.SetInactive(5, true)
+		db.SetInactive(-100, true)
+		if !db.IsInactive(5) || !db.IsInactive(-100) || db.IsInactive(6) {
+			t.Errorf("%s: inactive marks are wrong", backend)
+		}
+		db.SetInactive(5, false)
+		if db.IsInactive(5) || !db.IsInactive(-100) {
+			t.Errorf("%s: the mark is not cleared", backend)
+		}
+	}
+}
+
+func TestBoltOutboxSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := newBoltStorage(path)
+	first, second := newOutboxID(), newOutboxID()
+	db.AddOutbox(OutboxMessage{ID: second, Chat: 2, Text: "b", Created: time.Now()})
+	db.AddOutbox(OutboxMessage{ID: first, Chat: 1, Text: "a", Created: time.Now()})
+	db.SetInactive(3, true)
+	db.db.Close()
+
+	db = newBoltStorage(path)
+	defer db.db.Close()
+	outbox := db.Outbox()
+	if len(outbox) != 2 || outbox[0].ID != first || outbox[0].Text != "a" || outbox[1].ID != second {
+		t.Errorf("outbox after reopening = %v", outbox)
+	}
+	if !db.IsInactive(3) {
+		t.Error("the inactive mark is lost after reopening")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// dialogContext carries one incoming message through a dialog step.
+type dialogContext struct {
+	db Storage
+	id int64
+	// user is the sender of the message, who differs from the chat in groups.
+	user    int
+	group   bool
+	message string
+	state   map[string]string
+	// reply, if set by a step, is sent instead of the prompt of the next step.
+	reply *tgbotapi.MessageConfig
+}
+
+// step is a single state of a dialog.
+type step struct {
+	// prompt is sent when the dialog enters the step. Steps without a prompt are entered silently.
+	prompt   func(ctx *dialogContext) string
+	keyboard []string
+	// handle validates the message, acts on it and returns the name of the next step.
+	// A returned error is sent to the user, who stays on the current step.
+	handle func(ctx *dialogContext) (string, error)
+}
+
+type dialog struct {
+	steps map[string]*step
+}
+
+func newDialog() *dialog {
+	return &dialog{steps: make(map[string]*step)}
+}
+
+func (d *dialog) register(name string, s *step) {
+	if _, ok := d.steps[name]; ok {
+		panic("Step " + name + " is registered twice")
+	}
+	d.steps[name] = s
+}
+
+// run passes the message to the current step of the user.
+func (d *dialog) run(ctx *dialogContext) *tgbotapi.MessageConfig {
+	s, ok := d.steps[ctx.state["name"]]
+	if !ok {
+		ctx.state["name"] = ""
+		return makeMessage(ctx.id, "Not implemented yet", MENU_KB)
+	}
+	next, err := s.handle(ctx)
+	if err != nil {
+		return makeMessage(ctx.id, err.Error(), s.keyboard)
+	}
+	return d.enter(ctx, next)
+}
+
+// enter moves the user to the step and returns the message to send.
+func (d *dialog) enter(ctx *dialogContext, name string) *tgbotapi.MessageConfig {
+	ctx.state["name"] = name
+	if ctx.reply != nil {
+		return ctx.reply
+	}
+	s := d.steps[name]
+	if s == nil || s.prompt == nil {
+		return nil
+	}
+	return makeMessage(ctx.id, s.prompt(ctx), s.keyboard)
+}
+
+func staticPrompt(text string) func(ctx *dialogContext) string {
+	return func(ctx *dialogContext) string {
+		return text
+	}
+}
+
+// fail aborts the dialog and returns the user to the menu.
+func (ctx *dialogContext) fail(text string) (string, error) {
+	ctx.reply = makeMessage(ctx.id, text, MENU_KB)
+	return "", nil
+}
+
+func (ctx *dialogContext) record() (*Record, error) {
+	return decodeRecord(ctx.state["record"])
+}
+
+func (ctx *dialogContext) setRecord(rec *Record) {
+	ctx.state["record"] = rec.Encode()
+}
+
+var errBadCell = errors.New("Invalid cell, try again.")
+
+var errNotAdmin = errors.New("Only administrators of this chat can change the cells")
+
+// isAdmin reports whether the user may change the cells of the chat. Anyone can in a private chat.
+func (ctx *dialogContext) isAdmin() bool {
+	return !ctx.group || isChatAdmin(ctx.id, ctx.user)
+}
+
+// parseRange sets the range of the record from the message, which is either a range in A1 notation or TABS_STR.
+// The tab name of the range, if any, is returned for moveToTab, as finding it needs the document.
+func parseRange(rec *Record, message string) (string, error) {
+	if message == TABS_STR {
+		rec.SetTabs()
+		return "", nil
+	}
+	tab, col1, row1, col2, row2, ok := parseA1(message)
+	if !ok {
+		return "", errBadCell
+	}
+	rec.SetRange(col1, row1, col2, row2)
+	return tab, nil
+}
+
+// moveToTab moves the record to the tab with the given name. It fetches the document,
+// so it is called in the background.
+func moveToTab(rec *Record, tab string) error {
+	sheet, err := getTabList(rec)
+	if sheet == nil {
+		if err == nil {
+			err = errors.New("Could not fetch the table")
+		}
+		return errors.New(err.Error() + ", try again.")
+	}
+	t := sheet.TabByName(tab)
+	if t == nil {
+		return errors.New("There is no tab named " + tab + ", try again.")
+	}
+	rec.Gid = t.Gid
+	return nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// testPage is an htmlview document with the tabs "First" (gid 0) and "Second" (gid 77).
+const testPage = `<html><head></head><body><div id="top"><span>x</span><ul>` +
+	`<li id="sheet-button-0"><a>First</a></li><li id="sheet-button-77"><a>Second</a></li></ul></div>` +
+	`<div id="sheets"><div id="0"><div><table><thead><tr><th></th><th style="w">A</th><th style="w">B</th><th style="w">C</th></tr></thead><tbody>` +
+	`<tr style="h"><th><div>1</div></th><td>Order</td><td>Status</td><td>Price</td></tr>` +
+	`<tr style="h"><th><div>2</div></th><td>42</td><td>paid</td><td>10</td></tr>` +
+	`<tr style="h"><th><div>3</div></th><td>43</td><td>new</td><td>20</td></tr>` +
+	`</tbody></table></div></div>` +
+	`<div id="77"><div><table><thead><tr><th></th><th style="w">A</th></tr></thead><tbody>` +
+	`<tr style="h"><th><div>1</div></th><td>x</td></tr></tbody></table></div></div></div></body></html>`
+
+// stubFetcher serves a fixed htmlview document.
+type stubFetcher struct {
+	data string
+}
+
+func (f *stubFetcher) Fetch(name string, gid string, etag string, lastModified string) (*tableEntry, bool) {
+	return &tableEntry{data: f.data, fetched: time.Now()}, false
+}
+
+func (f *stubFetcher) Parse(gid string, data string) (*Sheet, error) {
+	return parseSheet(data)
+}
+
+// useFetchers replaces the fetchers for the duration of the test and turns the cache off.
+func useFetchers(t *testing.T, fs map[string]Fetcher) {
+	old, oldTTL, oldMode := fetchers, configMap["cachettl"], configMap["fetch"]
+	fetchers = fs
+	configMap["cachettl"] = "0s"
+	configMap["fetch"] = FETCH_AUTO
+	t.Cleanup(func() {
+		fetchers = old
+		configMap["cachettl"], configMap["fetch"] = oldTTL, oldMode
+	})
+}
+
+// runSteps passes the messages to the dialog one by one and returns the replies.
+func runSteps(db Storage, state map[string]string, messages ...string) []*tgbotapi.MessageConfig {
+	var res []*tgbotapi.MessageConfig
+	for _, m := range messages {
+		res = append(res, mainDialog.run(&dialogContext{db: db, id: 1, user: 1, message: m, state: state}))
+	}
+	return res
+}
+
+// initialValue waits for the message sent in the background when a record is saved.
+func initialValue(t *testing.T) string {
+	return nextMessage(t).Text
+}
+
+// nextMessage waits for a message sent in the background.
+func nextMessage(t *testing.T) *tgbotapi.MessageConfig {
+	select {
+	case m := <-messageChan:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("No message was sent")
+		return nil
+	}
+}
+
+// blockingFetcher serves a fixed htmlview document once release is closed.
+type blockingFetcher struct {
+	stubFetcher
+	release chan struct{}
+}
+
+func (f *blockingFetcher) Fetch(name string, gid string, etag string, lastModified string) (*tableEntry, bool) {
+	<-f.release
+	return f.stubFetcher.Fetch(name, gid, etag, lastModified)
+}
+
+func TestDialogAddRange(t *testing.T) {
+	useFetchers(t, map[string]Fetcher{FETCH_HTML: &stubFetcher{testPage}})
+	db := newMemoryStorage()
+	state := map[string]string{}
+	replies := runSteps(db, state, "Add a cell", "not a url",
+		"https://docs.google.com/spreadsheets/d/abc/edit#gid=0&range=C2", "", "price", "> 5")
+	for i, want := range []string{"Enter the cell URL", "Invalid url", "Enter the name", "Bad name", "When should I notify you"} {
+		if replies[i] == nil || !strings.HasPrefix(replies[i].Text, want) {
+			t.Errorf("reply %d = %v, want %q", i, replies[i], want)
+		}
+	}
+	if state["name"] != "" || replies[5] != nil {
+		t.Errorf("dialog did not finish: %v, %v", state, replies[5])
+	}
+	if text := initialValue(t); text != "New cell added!\nInitial value: '10'" {
+		t.Errorf("initial value message = %q", text)
+	}
+	value, ok := db.GetRecord(1, "price")
+	if !ok {
+		t.Fatal("record is not saved")
+	}
+	rec, _ := decodeRecord(value)
+	if rec.Spreadsheet != "d/abc" || rec.RangeString() != "C2" || rec.Options["condition"] != "> 5" {
+		t.Errorf("saved record = %+v", rec)
+	}
+	if replies := runSteps(db, state, "Add a cell", "https://docs.google.com/spreadsheets/d/abc/edit#gid=0&range=C3", "price"); !strings.HasPrefix(replies[2].Text, "This name is already used") {
+		t.Errorf("duplicate name reply = %q", replies[2].Text)
+	}
+}
+
+func TestDialogAddTable(t *testing.T) {
+	useFetchers(t, map[string]Fetcher{FETCH_HTML: &stubFetcher{testPage}})
+	db := newMemoryStorage()
+	rec := &Record{Version: RECORD_VERSION, Spreadsheet: "d/abc", Gid: "0", Kind: KIND_RANGE}
+	state := map[string]string{"name": "add-cell", "record": rec.Encode()}
+	replies := runSteps(db, state, TABLE_STR, "A2:C", "D", "A", "orders")
+	for i, want := range []string{"Which columns", "Which column identifies", "Enter a column between A and C", "Enter the name", ""} {
+		if want == "" {
+			if replies[i] != nil {
+				t.Errorf("reply %d = %q, want none", i, replies[i].Text)
+			}
+		} else if replies[i] == nil || !strings.HasPrefix(replies[i].Text, want) {
+			t.Errorf("reply %d = %v, want %q", i, replies[i], want)
+		}
+	}
+	if text := initialValue(t); text != "New cell added!\nInitial value: '2 rows'" {
+		t.Errorf("initial value message = %q", text)
+	}
+	value, _ := db.GetRecord(1, "orders")
+	saved, err := decodeRecord(value)
+	if err != nil || saved.Kind != KIND_TABLE || saved.Options["key"] != "A" || saved.RangeString() != "A2:C, rows by A" {
+		t.Errorf("saved record = %+v, %v", saved, err)
+	}
+}
+
+func TestDialogEdit(t *testing.T) {
+	useFetchers(t, map[string]Fetcher{FETCH_HTML: &stubFetcher{testPage}})
+	db := newMemoryStorage()
+	rec := &Record{Version: RECORD_VERSION, Spreadsheet: "d/abc", Gid: "0", Kind: KIND_RANGE}
+	rec.SetRange("C", "2", "", "")
+	db.AddRecord(1, "price", rec.Encode())
+	db.UpdateCellVal(1, "price", "10")
+	state := map[string]string{"name": "edit"}
+	replies := runSteps(db, state, "2", "1", "nope", "C3")
+	if !strings.HasPrefix(replies[0].Text, "Bad number") || !strings.HasSuffix(replies[1].Text, "Currently: C2") ||
+		!strings.HasPrefix(replies[2].Text, "Invalid cell") || replies[3] != nil {
+		t.Errorf("replies = %q, %q, %q, %v", replies[0].Text, replies[1].Text, replies[2].Text, replies[3])
+	}
+	if text := initialValue(t); text != "New cell added!\nInitial value: '20'" {
+		t.Errorf("initial value message = %q", text)
+	}
+	value, _ := db.GetRecord(1, "price")
+	if edited, _ := decodeRecord(value); edited.RangeString() != "C3" {
+		t.Errorf("edited record = %+v", edited)
+	}
+	if _, ok := db.GetCellVal(1, "price"); ok {
+		t.Error("the value of the old cell is kept")
+	}
+}
+
+func TestDialogDelete(t *testing.T) {
+	db := newMemoryStorage()
+	for _, name := range []string{"a", "b", "c"} {
+		db.AddRecord(1, name, (&Record{Version: RECORD_VERSION, Kind: KIND_TABS}).Encode())
+		db.UpdateCellVal(1, name, "x")
+	}
+	state := map[string]string{"name": "delete"}
+	replies := runSteps(db, state, "1, 4", "1, 3")
+	if !strings.HasPrefix(replies[0].Text, "Bad number") || replies[1].Text != "Deleted!" {
+		t.Errorf("replies = %q, %q", replies[0].Text, replies[1].Text)
+	}
+	if pairs := db.RecordList(1); len(pairs) != 1 || pairs[0].Name != "b" {
+		t.Errorf("records left = %v", pairs)
+	}
+	if _, ok := db.GetCellVal(1, "a"); ok {
+		t.Error("the value of a deleted record is kept")
+	}
+	if state["name"] != "" {
+		t.Errorf("dialog did not finish: %v", state)
+	}
+}
+
+func TestDialogRangeCondition(t *testing.T) {
+	useFetchers(t, map[string]Fetcher{FETCH_HTML: &stubFetcher{testPage}})
+	db := newMemoryStorage()
+	state := map[string]string{}
+	replies := runSteps(db, state, "Add a cell", "https://docs.google.com/spreadsheets/d/abc/edit#gid=0&range=C2:C3", "prices", "> 100", "matches 5")
+	if text := replies[2].Text; !strings.HasPrefix(text, RANGE_CONDITION_HELP) {
+		t.Errorf("condition prompt = %q", text)
+	}
+	if text := replies[3].Text; !strings.HasPrefix(text, "Numbers can only be compared for a single cell") {
+		t.Errorf("reply to a numeric condition = %q", text)
+	}
+	if replies[4] != nil {
+		t.Errorf("reply to matches = %q, want none", replies[4].Text)
+	}
+	initialValue(t)
+	value, _ := db.GetRecord(1, "prices")
+	if rec, _ := decodeRecord(value); rec == nil || rec.Options["condition"] != "matches 5" {
+		t.Errorf("saved record = %+v", rec)
+	}
+}
+
+func TestDialogEditTable(t *testing.T) {
+	useFetchers(t, map[string]Fetcher{FETCH_HTML: &stubFetcher{testPage}})
+	db := newMemoryStorage()
+	rec := &Record{Version: RECORD_VERSION, Spreadsheet: "d/abc", Gid: "0", Kind: KIND_RANGE}
+	rec.SetRange("C", "2", "", "")
+	db.AddRecord(1, "orders", rec.Encode())
+	state := map[string]string{"name": "edit"}
+	replies := runSteps(db, state, "1", TABLE_STR, "A2:C", "B")
+	if !strings.HasPrefix(replies[1].Text, "Which columns") || !strings.HasPrefix(replies[2].Text, "Which column identifies") || replies[3] != nil {
+		t.Errorf("replies = %q, %q, %v", replies[1].Text, replies[2].Text, replies[3])
+	}
+	if text := initialValue(t); text != "New cell added!\nInitial value: '2 rows'" {
+		t.Errorf("initial value message = %q", text)
+	}
+	value, _ := db.GetRecord(1, "orders")
+	if edited, _ := decodeRecord(value); edited == nil || edited.Kind != KIND_TABLE || edited.RangeString() != "A2:C, rows by B" {
+		t.Errorf("edited record = %+v", edited)
+	}
+	if pairs := db.RecordList(1); len(pairs) != 1 || state["name"] != "" || state["editing"] != "" {
+		t.Errorf("records = %v, state = %v", pairs, state)
+	}
+
+	// Editing the table into a range drops the key
+	state = map[string]string{"name": "edit"}
+	runSteps(db, state, "1", "C3")
+	initialValue(t)
+	value, _ = db.GetRecord(1, "orders")
+	if edited, _ := decodeRecord(value); edited == nil || edited.Kind != KIND_RANGE || edited.Options["key"] != "" {
+		t.Errorf("edited record = %+v", edited)
+	}
+}
+
+func TestDialogRangeOnTab(t *testing.T) {
+	fetcher := &blockingFetcher{stubFetcher{testPage}, make(chan struct{})}
+	useFetchers(t, map[string]Fetcher{FETCH_HTML: fetcher})
+	db := newMemoryStorage()
+	send := func(text string) *tgbotapi.MessageConfig {
+		return handle(db, &chatMessage{chat: 1, user: 1, text: text})
+	}
+	rec := &Record{Version: RECORD_VERSION, Spreadsheet: "d/abc", Gid: "0", Kind: KIND_RANGE}
+	db.SetState(1, map[string]string{"name": "add-cell", "record": rec.Encode()}, time.Hour)
+	done := make(chan *tgbotapi.MessageConfig)
+	go func() {
+		done <- send("'Nope'!A1")
+	}()
+	select {
+	case reply := <-done:
+		if reply != nil {
+			t.Errorf("reply while the table is fetched = %q", reply.Text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the update loop waits for the fetch")
+	}
+	if reply := send("A1"); reply == nil || !strings.HasPrefix(reply.Text, "Still looking at the table") {
+		t.Errorf("reply to a message while checking = %v", reply)
+	}
+	close(fetcher.release)
+	if msg := nextMessage(t); !strings.HasPrefix(msg.Text, "There is no tab named Nope") {
+		t.Errorf("reply to a missing tab = %q", msg.Text)
+	}
+	if st := db.GetState(1); st["name"] != "add-cell" {
+		t.Errorf("state after a missing tab = %v", st)
+	}
+	if reply := send("'Second'!A1"); reply != nil {
+		t.Errorf("reply = %q, want none until the tab is found", reply.Text)
+	}
+	if msg := nextMessage(t); !strings.HasPrefix(msg.Text, "Enter the name") {
+		t.Errorf("reply to a range on a tab = %q", msg.Text)
+	}
+	st := db.GetState(1)
+	if saved, _ := decodeRecord(st["record"]); st["name"] != "add-name" || saved == nil || saved.Gid != "77" || saved.RangeString() != "A1" {
+		t.Errorf("state = %v", st)
+	}
+}
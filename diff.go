@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DIFF_MAX_LENGTH keeps notifications below the Telegram message limit.
+	DIFF_MAX_LENGTH = 3500
+	// VALUE_MAX_LENGTH is the number of characters of a value shown in a notification.
+	VALUE_MAX_LENGTH = 500
+)
+
+// RANGE_PREFIX starts every stored range value. Older versions stored ranges as the cells joined by tabs.
+const RANGE_PREFIX = `{"rows":`
+
+// RangeValue is the value of a range of cells.
+type RangeValue struct {
+	// Rows and Cols are the labels of the rows and columns of the range, e.g. "5" and "C".
+	Rows []string `json:"rows"`
+	Cols []string `json:"cols"`
+	// Cells[r][c] is nil for positions covered by merged cells.
+	Cells [][]*string `json:"cells"`
+}
+
+func (v *RangeValue) Encode() string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// Flatten joins the cells with tabs, the way ranges used to be stored.
+func (v *RangeValue) Flatten() string {
+	result := ""
+	for _, row := range v.Cells {
+		for _, c := range row {
+			if c != nil {
+				result += *c + "\t"
+			}
+		}
+	}
+	return strings.Trim(result, "\t")
+}
+
+// cellMap returns the text of every cell by its name, e.g. "B3", and the names in order.
+func (v *RangeValue) cellMap() (map[string]string, []string) {
+	res := make(map[string]string)
+	var names []string
+	for r, row := range v.Cells {
+		for c, text := range row {
+			if r >= len(v.Rows) || c >= len(v.Cols) {
+				continue
+			}
+			name := v.Cols[c] + v.Rows[r]
+			names = append(names, name)
+			if text != nil {
+				res[name] = *text
+			}
+		}
+	}
+	return res, names
+}
+
+// TABLE_PREFIX starts every stored table value.
+const TABLE_PREFIX = `{"table":`
+
+// TableValue is the value of a table record.
+type TableValue struct {
+	// Key is the label of the key column.
+	Key string `json:"table"`
+	// Cols are the labels of the columns of the table.
+	Cols []string `json:"cols"`
+	// Keys[i] identifies Rows[i].
+	Keys []string   `json:"keys"`
+	Rows [][]string `json:"rows"`
+}
+
+func (v *TableValue) Encode() string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// decodeTableValue parses a stored table value.
+func decodeTableValue(s string) (*TableValue, bool) {
+	if !strings.HasPrefix(s, TABLE_PREFIX) {
+		return nil, false
+	}
+	var v TableValue
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return nil, false
+	}
+	return &v, true
+}
+
+// formatRow shows a row in a notification.
+func formatRow(row []string) string {
+	res := make([]string, len(row))
+	for i, v := range row {
+		res[i] = html.EscapeString(shorten(v))
+	}
+	return strings.Join(res, " | ")
+}
+
+// diffTables lists the added, removed and modified rows of a table.
+// ok is false if either value is not a table.
+func diffTables(old string, new string) (lines []string, ok bool) {
+	n, ok := decodeTableValue(new)
+	if !ok {
+		return nil, false
+	}
+	o, ok := decodeTableValue(old)
+	if !ok {
+		return nil, false
+	}
+	oldRows := make(map[string][]string)
+	for i, key := range o.Keys {
+		oldRows[key] = o.Rows[i]
+	}
+	newRows := make(map[string]bool)
+	for i, key := range n.Keys {
+		newRows[key] = true
+		row, found := oldRows[key]
+		if !found {
+			lines = append(lines, "+ "+formatRow(n.Rows[i]))
+			continue
+		}
+		for c, text := range n.Rows[i] {
+			was := ""
+			if c < len(row) {
+				was = row[c]
+			}
+			if was != text && c < len(n.Cols) {
+				lines = append(lines, "~ "+html.EscapeString(key)+", "+formatCellChange(n.Cols[c], was, text))
+			}
+		}
+	}
+	for i, key := range o.Keys {
+		if !newRows[key] {
+			lines = append(lines, "- "+formatRow(o.Rows[i]))
+		}
+	}
+	return lines, true
+}
+
+// TABS_PREFIX starts every stored tab list. Older versions stored the names joined by commas.
+const TABS_PREFIX = `{"tabs":`
+
+// TabsValue is the value of a tab list record.
+type TabsValue struct {
+	Tabs []TabInfo `json:"tabs"`
+}
+
+type TabInfo struct {
+	Gid  string `json:"gid"`
+	Name string `json:"name"`
+}
+
+func (v *TabsValue) Encode() string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// Names joins the names of the tabs, the way tab lists used to be stored.
+func (v *TabsValue) Names() string {
+	names := make([]string, len(v.Tabs))
+	for i, tab := range v.Tabs {
+		names[i] = tab.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// decodeTabsValue parses a stored tab list.
+func decodeTabsValue(s string) (*TabsValue, bool) {
+	if !strings.HasPrefix(s, TABS_PREFIX) {
+		return nil, false
+	}
+	var v TabsValue
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return nil, false
+	}
+	return &v, true
+}
+
+// diffTabs lists the tabs that were added, renamed or deleted. Tabs are matched by their gids.
+// ok is false if either value is not a tab list.
+func diffTabs(old string, new string) (lines []string, ok bool) {
+	n, ok := decodeTabsValue(new)
+	if !ok {
+		return nil, false
+	}
+	o, ok := decodeTabsValue(old)
+	if !ok {
+		if old == n.Names() {
+			// The same value stored in the old format
+			return nil, true
+		}
+		return nil, false
+	}
+	oldNames := make(map[string]string)
+	for _, tab := range o.Tabs {
+		oldNames[tab.Gid] = tab.Name
+	}
+	seen := make(map[string]bool)
+	var order, oldOrder []string
+	for _, tab := range n.Tabs {
+		seen[tab.Gid] = true
+		name, found := oldNames[tab.Gid]
+		if !found {
+			lines = append(lines, "Tab '"+html.EscapeString(tab.Name)+"' added")
+			continue
+		}
+		order = append(order, tab.Gid)
+		if name != tab.Name {
+			lines = append(lines, "Tab '"+html.EscapeString(name)+"' renamed to '"+html.EscapeString(tab.Name)+"'")
+		}
+	}
+	for _, tab := range o.Tabs {
+		if !seen[tab.Gid] {
+			lines = append(lines, "Tab '"+html.EscapeString(tab.Name)+"' deleted")
+			continue
+		}
+		oldOrder = append(oldOrder, tab.Gid)
+	}
+	if strings.Join(order, ",") != strings.Join(oldOrder, ",") {
+		lines = append(lines, "Tabs reordered: "+html.EscapeString(n.Names()))
+	}
+	return lines, true
+}
+
+// decodeRangeValue parses a stored range value.
+func decodeRangeValue(s string) (*RangeValue, bool) {
+	if !strings.HasPrefix(s, RANGE_PREFIX) {
+		return nil, false
+	}
+	var v RangeValue
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return nil, false
+	}
+	return &v, true
+}
+
+// displayValue returns a stored value the way it is shown to the user.
+func displayValue(s string) string {
+	if v, ok := decodeRangeValue(s); ok {
+		return v.Flatten()
+	}
+	if v, ok := decodeTableValue(s); ok {
+		return strconv.Itoa(len(v.Rows)) + " rows"
+	}
+	if v, ok := decodeTabsValue(s); ok {
+		return v.Names()
+	}
+	return s
+}
+
+// diffRanges lists the cells that differ between two range values.
+// ok is false if either value is not a range.
+func diffRanges(old string, new string) (lines []string, ok bool) {
+	n, ok := decodeRangeValue(new)
+	if !ok {
+		return nil, false
+	}
+	o, ok := decodeRangeValue(old)
+	if !ok {
+		if old == n.Flatten() {
+			// The same value stored in the old format
+			return nil, true
+		}
+		return nil, false
+	}
+	oldCells, oldNames := o.cellMap()
+	newCells, newNames := n.cellMap()
+	seen := make(map[string]bool)
+	for _, name := range newNames {
+		seen[name] = true
+		if oldCells[name] != newCells[name] {
+			lines = append(lines, formatCellChange(name, oldCells[name], newCells[name]))
+		}
+	}
+	for _, name := range oldNames {
+		if !seen[name] && oldCells[name] != "" {
+			lines = append(lines, formatCellChange(name, oldCells[name], ""))
+		}
+	}
+	return lines, true
+}
+
+func formatCellChange(name string, old string, new string) string {
+	return name + ": '" + html.EscapeString(shorten(old)) + "' -> '" + html.EscapeString(shorten(new)) + "'"
+}
+
+// shorten cuts values that are too long to be shown in full.
+func shorten(s string) string {
+	runes := []rune(s)
+	if len(runes) <= VALUE_MAX_LENGTH {
+		return s
+	}
+	return string(runes[:VALUE_MAX_LENGTH]) + "…"
+}
+
+// changeMessage builds the notification about a change of the value.
+// ok is false if there is nothing to report, which happens when a value stored
+// in the old format is seen for the first time.
+func changeMessage(rec *Record, name string, old string, new string) (msg string, ok bool) {
+	header := fmt.Sprintf("<a href=\"%s\">%s</a> changed!", buildEditURL(rec), html.EscapeString(name))
+	var lines []string
+	structured := false
+	for _, diff := range []func(string, string) ([]string, bool){diffRanges, diffTables, diffTabs} {
+		if lines, structured = diff(old, new); structured {
+			break
+		}
+	}
+	if !structured {
+		return header + "\n'" + html.EscapeString(shorten(displayValue(old))) + "' -> '" + html.EscapeString(shorten(displayValue(new))) + "'", true
+	}
+	if len(lines) == 0 {
+		return "", false
+	}
+	return header + joinLines(lines), true
+}
+
+// joinLines joins as many lines as fit into a message and counts the rest.
+func joinLines(lines []string) string {
+	res := ""
+	for i, line := range lines {
+		if len(res)+len(line) > DIFF_MAX_LENGTH {
+			return res + "\n... and " + strconv.Itoa(len(lines)-i) + " more"
+		}
+		res += "\n" + line
+	}
+	return res
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// rangeValue builds a stored range value. cells lists the texts row by row.
+func rangeValue(rows []string, cols []string, cells ...string) string {
+	v := &RangeValue{Rows: rows, Cols: cols}
+	for r := range rows {
+		var row []*string
+		for c := range cols {
+			text := cells[r*len(cols)+c]
+			row = append(row, &text)
+		}
+		v.Cells = append(v.Cells, row)
+	}
+	return v.Encode()
+}
+
+func TestDiffRanges(t *testing.T) {
+	ab := []string{"A", "B"}
+	old := rangeValue([]string{"1", "2"}, ab, "a1", "b1", "a2", "b2")
+	tests := []struct {
+		name  string
+		old   string
+		new   string
+		lines []string
+		ok    bool
+	}{
+		{"cell changed", old, rangeValue([]string{"1", "2"}, ab, "a1", "x", "a2", "b2"), []string{"B1: 'b1' -> 'x'"}, true},
+		{"rows shrunk out", old, rangeValue([]string{"1"}, ab, "a1", "b1"), []string{"A2: 'a2' -> ''", "B2: 'b2' -> ''"}, true},
+		{"old format, same value", "a1\tb1\ta2\tb2", old, nil, true},
+		{"old format, other value", "a1\tb1", old, nil, false},
+		{"not a range", "x", "y", nil, false},
+		{"escaped", rangeValue([]string{"1"}, []string{"A"}, "a"), rangeValue([]string{"1"}, []string{"A"}, "<b>"), []string{"A1: 'a' -> '&lt;b&gt;'"}, true},
+	}
+	for _, test := range tests {
+		lines, ok := diffRanges(test.old, test.new)
+		if ok != test.ok || !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("%s: diffRanges = %q, %v, want %q, %v", test.name, lines, ok, test.lines, test.ok)
+		}
+	}
+	rec := &Record{Version: RECORD_VERSION, Spreadsheet: "d/abc", Gid: "0", Kind: KIND_RANGE}
+	if msg, ok := changeMessage(rec, "r", "a1\tb1\ta2\tb2", old); ok {
+		t.Errorf("a value in the old format is notified: %q", msg)
+	}
+}
+
+func TestJoinLines(t *testing.T) {
+	line := strings.Repeat("x", 1000)
+	lines := []string{line, line, line, line, line}
+	res := joinLines(lines)
+	if !strings.HasSuffix(res, "\n... and 2 more") || strings.Count(res, line) != 3 {
+		t.Errorf("joinLines kept %d lines: %q", strings.Count(res, line), res[len(res)-20:])
+	}
+	if len(res) > DIFF_MAX_LENGTH+100 {
+		t.Errorf("joined length %d", len(res))
+	}
+	if res := joinLines([]string{"a", "b"}); res != "\na\nb" {
+		t.Errorf("joinLines = %q", res)
+	}
+}
+
+// htmlPage builds an htmlview document with the single tab "First" (gid 0) holding the rows.
+func htmlPage(rows ...[]string) string {
+	page := `<html><head></head><body><div id="top"><span>x</span><ul><li id="sheet-button-0"><a>First</a></li></ul></div>` +
+		`<div id="sheets"><div id="0"><div><table><thead><tr><th></th>`
+	for c := range rows[0] {
+		page += `<th style="w">` + string(rune('A'+c)) + `</th>`
+	}
+	page += `</tr></thead><tbody>`
+	for r, row := range rows {
+		page += `<tr style="h"><th><div>` + strconv.Itoa(r+1) + `</div></th>`
+		for _, text := range row {
+			page += `<td>` + text + `</td>`
+		}
+		page += `</tr>`
+	}
+	return page + `</tbody></table></div></div></div></body></html>`
+}
+
+func TestExtractTable(t *testing.T) {
+	sheet, err := parseSheet(htmlPage(
+		[]string{"Order", "Status"},
+		[]string{"42", "paid"},
+		[]string{"", "orphan"},
+		[]string{"43", "new"},
+		[]string{"42", "again"},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := extractTable(sheet, "0", "2", "A", "B", "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &TableValue{Key: "A", Cols: []string{"A", "B"}, Keys: []string{"42", "43", "42 (2)"},
+		Rows: [][]string{{"42", "paid"}, {"43", "new"}, {"42", "again"}}}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("extractTable = %+v, want %+v", v, want)
+	}
+	if _, err := extractTable(sheet, "0", "2", "A", "A", "B"); err == nil {
+		t.Error("a key outside of the table is accepted")
+	}
+}
+
+func TestDiffTables(t *testing.T) {
+	table := func(keys []string, rows ...[]string) string {
+		return (&TableValue{Key: "A", Cols: []string{"A", "B"}, Keys: keys, Rows: rows}).Encode()
+	}
+	old := table([]string{"42", "43", "42 (2)"}, []string{"42", "paid"}, []string{"43", "new"}, []string{"42", "again"})
+	tests := []struct {
+		name  string
+		new   string
+		lines []string
+	}{
+		{"same", old, nil},
+		{"added", table([]string{"42", "43", "42 (2)", "44"}, []string{"42", "paid"}, []string{"43", "new"}, []string{"42", "again"}, []string{"44", "new"}),
+			[]string{"+ 44 | new"}},
+		{"removed", table([]string{"42", "42 (2)"}, []string{"42", "paid"}, []string{"42", "again"}),
+			[]string{"- 43 | new"}},
+		{"modified", table([]string{"42", "43", "42 (2)"}, []string{"42", "paid"}, []string{"43", "paid"}, []string{"42", "again"}),
+			[]string{"~ 43, B: 'new' -> 'paid'"}},
+		{"duplicate removed", table([]string{"42", "43"}, []string{"42", "paid"}, []string{"43", "new"}),
+			[]string{"- 42 | again"}},
+	}
+	for _, test := range tests {
+		lines, ok := diffTables(old, test.new)
+		if !ok || !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("%s: diffTables = %q, %v, want %q", test.name, lines, ok, test.lines)
+		}
+	}
+	if _, ok := diffTables("2 rows", old); ok {
+		t.Error("a value that is not a table is diffed")
+	}
+}
+
+func TestDiffTabs(t *testing.T) {
+	tabs := func(tabs ...TabInfo) string {
+		return (&TabsValue{Tabs: tabs}).Encode()
+	}
+	first, second := TabInfo{"0", "First"}, TabInfo{"77", "Second"}
+	old := tabs(first, second)
+	tests := []struct {
+		name  string
+		old   string
+		new   string
+		lines []string
+		ok    bool
+	}{
+		{"same", old, old, nil, true},
+		{"added", old, tabs(first, second, TabInfo{"5", "Third"}), []string{"Tab 'Third' added"}, true},
+		{"renamed", old, tabs(first, TabInfo{"77", "Totals"}), []string{"Tab 'Second' renamed to 'Totals'"}, true},
+		{"deleted", old, tabs(second), []string{"Tab 'First' deleted"}, true},
+		{"reordered", old, tabs(second, first), []string{"Tabs reordered: Second, First"}, true},
+		{"old format, same value", "First, Second", old, nil, true},
+		{"old format, other value", "First", old, nil, false},
+		{"not a tab list", "a", "b", nil, false},
+	}
+	for _, test := range tests {
+		lines, ok := diffTabs(test.old, test.new)
+		if ok != test.ok || !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("%s: diffTabs = %q, %v, want %q, %v", test.name, lines, ok, test.lines, test.ok)
+		}
+	}
+}
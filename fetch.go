@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Fetcher downloads documents in one format and parses them into the grid model.
+type Fetcher interface {
+	// Fetch downloads the document. gid selects the tab for the formats that are read
+	// one tab at a time; it is empty when only the list of tabs is needed.
+	// If the validators of the cached copy are passed and the document has not changed since,
+	// notModified is set and the entry is nil. The entry is also nil if the fetch failed.
+	Fetch(name string, gid string, etag string, lastModified string) (entry *tableEntry, notModified bool)
+	Parse(gid string, data string) (*Sheet, error)
+}
+
+// fetchers maps the fetch modes to their implementations.
+var fetchers = make(map[string]Fetcher)
+
+// httpClient is shared by all fetchers. It limits the number of concurrent requests
+// and identifies the bot with its User-Agent.
+type httpClient struct {
+	client    *http.Client
+	userAgent string
+	slots     chan struct{}
+}
+
+func newHTTPClient(timeout time.Duration, proxy string, userAgent string, limit int) *httpClient {
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			log.Panic("Bad proxy URL: " + err.Error())
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	return &httpClient{
+		client:    &http.Client{Timeout: timeout, Transport: transport},
+		userAgent: userAgent,
+		slots:     make(chan struct{}, limit),
+	}
+}
+
+// do sends the request and passes the response to fn. The request counts against
+// the limit until fn returns.
+func (c *httpClient) do(req *http.Request, fn func(resp *http.Response) error) error {
+	c.slots <- struct{}{}
+	defer func() { <-c.slots }()
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return fn(resp)
+}
+
+// get downloads the document. If the validators of the cached copy are passed
+// and the document has not changed since, notModified is set and nothing is downloaded.
+// Responses of a different content type, like the Google login page served
+// instead of a private document, count as failures.
+func (c *httpClient) get(url string, contentType string, etag string, lastModified string) (entry *tableEntry, notModified bool) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, false
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	err = c.do(req, func(resp *http.Response) error {
+		if resp.StatusCode == http.StatusNotModified && (etag != "" || lastModified != "") {
+			notModified = true
+			return nil
+		}
+		if resp.StatusCode != 200 {
+			log.Println("Unable to fetch " + url + ": " + resp.Status)
+			return nil
+		}
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), contentType) {
+			log.Println("Unable to fetch " + url + ": unexpected " + resp.Header.Get("Content-Type"))
+			return nil
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		entry = &tableEntry{
+			data:         string(body),
+			etag:         resp.Header.Get("ETag"),
+			lastModified: resp.Header.Get("Last-Modified"),
+			fetched:      time.Now(),
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Unable to fetch " + url + ": " + err.Error())
+	}
+	return
+}
+
+// htmlFetcher reads the htmlview and pubhtml pages, which contain every tab of the document.
+type htmlFetcher struct {
+	http    *httpClient
+	baseURL string
+}
+
+func (f *htmlFetcher) Fetch(name string, gid string, etag string, lastModified string) (*tableEntry, bool) {
+	if strings.HasSuffix(name, "/pubhtml") {
+		return f.http.get(f.baseURL+name, "text/html", etag, lastModified)
+	}
+	return f.http.get(f.baseURL+name+"/htmlview", "text/html", etag, lastModified)
+}
+
+func (f *htmlFetcher) Parse(gid string, data string) (*Sheet, error) {
+	return parseSheet(data)
+}
+
+// csvFetcher reads a single tab through the CSV export. It does not depend on the markup
+// of the HTML view, but knows nothing about hidden rows and merged cells.
+type csvFetcher struct {
+	http    *httpClient
+	baseURL string
+}
+
+func (f *csvFetcher) Fetch(name string, gid string, etag string, lastModified string) (*tableEntry, bool) {
+	if strings.HasSuffix(name, "/pubhtml") {
+		return f.http.get(f.baseURL+strings.TrimSuffix(name, "/pubhtml")+"/pub?output=csv&gid="+gid, "text/csv", etag, lastModified)
+	}
+	return f.http.get(f.baseURL+name+"/export?format=csv&gid="+gid, "text/csv", etag, lastModified)
+}
+
+func (f *csvFetcher) Parse(gid string, data string) (*Sheet, error) {
+	return parseCSVSheet(gid, data)
+}
+
+// setupFetchers creates the fetchers from the command line flags.
+func setupFetchers() {
+	client := newHTTPClient(configDuration("timeout"), configMap["proxy"], configMap["useragent"], configInt("fetches"))
+	fetchers[FETCH_HTML] = &htmlFetcher{client, configMap["baseurl"]}
+	fetchers[FETCH_CSV] = &csvFetcher{client, configMap["baseurl"]}
+	if configMap["apikey"] != "" || configMap["credentials"] != "" {
+		fetchers[FETCH_API] = newAPIFetcher(client, configMap["sheetsapi"], configMap["apikey"], configMap["credentials"])
+	}
+}
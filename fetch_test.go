@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// googleStandIn serves the htmlview and the CSV export of the document "d/abc".
+type googleStandIn struct {
+	lock sync.Mutex
+	page string
+	csv  string
+}
+
+func (g *googleStandIn) set(page string, csv string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.page, g.csv = page, csv
+}
+
+func (g *googleStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	switch {
+	case r.URL.Path == "/d/abc/htmlview" && g.page != "":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(g.page))
+	case r.URL.Path == "/d/abc/export" && r.URL.Query().Get("format") == "csv" && g.csv != "":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Write([]byte(g.csv))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestEndToEnd(t *testing.T) {
+	google := &googleStandIn{}
+	google.set(testPage, "")
+	srv := httptest.NewServer(google)
+	defer srv.Close()
+	client := testClient()
+	useFetchers(t, map[string]Fetcher{
+		FETCH_HTML: &htmlFetcher{client, srv.URL + "/"},
+		FETCH_CSV:  &csvFetcher{client, srv.URL + "/"},
+	})
+	db := newMemoryStorage()
+	for _, text := range []string{"Add a cell", "https://docs.google.com/spreadsheets/d/abc/edit#gid=0&range=C2", "price", "Any change"} {
+		handle(db, &chatMessage{chat: 1, user: 1, text: text})
+	}
+	if text := initialValue(t); text != "New cell added!\nInitial value: '10'" {
+		t.Errorf("initial value message = %q", text)
+	}
+	runMonitorCycle(db, 1)
+	if outbox := db.Outbox(); len(outbox) != 0 {
+		t.Errorf("notified before a change: %v", outbox)
+	}
+
+	google.set(strings.Replace(testPage, "<td>10</td>", "<td>15</td>", 1), "")
+	runMonitorCycle(db, 1)
+	outbox := db.Outbox()
+	if len(outbox) != 1 || outbox[0].Chat != 1 || !strings.Contains(outbox[0].Text, "price</a> changed!\n'10' -> '15'") {
+		t.Fatalf("outbox = %v", outbox)
+	}
+	db.DeleteOutbox(outbox[0].ID)
+
+	// The CSV export is used when the HTML view cannot be read
+	google.set("", "Order,Status,Price\n42,paid,16\n")
+	runMonitorCycle(db, 1)
+	outbox = db.Outbox()
+	if len(outbox) != 1 || !strings.Contains(outbox[0].Text, "'15' -> '16'") {
+		t.Errorf("outbox = %v", outbox)
+	}
+}
+
+func TestBaseURLSlash(t *testing.T) {
+	old := flag.Lookup("baseurl").Value.String()
+	defer func() {
+		flag.Set("baseurl", old)
+		loadConfig()
+	}()
+	flag.Set("baseurl", "http://localhost:8080/spreadsheets")
+	loadConfig()
+	if base := configMap["baseurl"]; base != "http://localhost:8080/spreadsheets/" {
+		t.Errorf("baseurl = %q", base)
+	}
+}
+
+func TestRecordSourceFallback(t *testing.T) {
+	csvPage := strings.Replace(testPage, "First", "Renamed", 1)
+	useFetchers(t, map[string]Fetcher{FETCH_HTML: &stubFetcher{testPage}, FETCH_CSV: &stubFetcher{csvPage}})
+	tests := []struct {
+		gid  string
+		want string
+	}{
+		{"0", testPage},
+		// No source has the tab, the first readable document is returned
+		{"5", testPage},
+	}
+	for _, test := range tests {
+		rec := &Record{Version: RECORD_VERSION, Spreadsheet: "d/abc", Gid: test.gid, Kind: KIND_RANGE}
+		entry, sheet, err := recordSource(rec)
+		if entry == nil || err != nil || sheet == nil {
+			t.Fatalf("gid %s: recordSource = %v, %v, %v", test.gid, entry, sheet, err)
+		}
+		if entry.data != test.want {
+			t.Errorf("gid %s: the document of the wrong source is returned", test.gid)
+		}
+	}
+	useFetchers(t, map[string]Fetcher{FETCH_HTML: &stubFetcher{"not a sheet"}})
+	if entry, _, err := recordSource(&Record{Version: RECORD_VERSION, Spreadsheet: "d/abc", Gid: "0", Kind: KIND_RANGE}); entry == nil || err == nil {
+		t.Errorf("a broken document: %v, %v", entry, err)
+	}
+}
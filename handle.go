@@ -1,18 +1,31 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-telegram-bot-api/telegram-bot-api"
 )
 
-var state = make(map[int64]map[string]string)
 var MENU_KB = []string{"Add a cell", "List all cells"}
 
 const TABS_STR = "Monitor tabs"
+const TABLE_STR = "Monitor rows"
+const LOOKUP_STR = "Find by title"
 const HELP_STR = `You can add cells or cell ranges here. I will check them about once a minute, and if the value changes, I will notify you.
+To watch a list that grows, like orders or signups, choose "` + TABLE_STR + `" instead of a cell. I will tell you which rows were added, removed or modified.
+If columns or rows of your sheet move around, choose "` + LOOKUP_STR + `" to find the cell by the title of its column and a value in its row.
+You can also add me to a group. There, address commands to me like /help@botname, and only administrators of the group can change the cells.
+Bots do not see other messages in groups, so use /add and /list instead of the buttons and reply to my questions.
+
+/history <name> - show the last changes of the cell
+/chart <name> - draw a chart of the numeric values of the cell
+/share <name> - get an invite for other users to receive the notifications about the cell, /unshare <name> to revoke it
+/unsubscribe <name or invite code> - stop receiving the notifications about a cell shared with you
+/notify @channel <name> - send the notifications about the cell to a channel where I am an administrator, /notify off <name> to stop
+/fetch html|csv|api|auto|default <name> - choose how the cell is downloaded. Try csv if the cell cannot be read from the html view, or api for private sheets shared with the bot.
 `
 
 func makeKeyboard(kb []string) interface{} {
@@ -51,83 +64,669 @@ func makeMessageInline(id int64, text string, kb []string) *tgbotapi.MessageConf
 	return &msg
 }
 
-func formatRecordList(uid int64, pairs StringPairs) string {
+func formatRecordList(db Storage, uid int64, pairs StringPairs) string {
 	if len(pairs) == 0 {
 		return "You have no cells yet"
 	}
 	res := ""
 	for i, v := range pairs {
 		res += strconv.Itoa(i+1) + ". " + v.Name
-		val, ok := getCellVal(uid, v.Name)
+		val, ok := db.GetCellVal(uid, v.Name)
 		if ok {
-			res += " ('" + val + "')"
+			res += " ('" + displayValue(val) + "')"
+		}
+		rec, err := decodeRecord(v.Value)
+		if err != nil {
+			res += "\nBroken record: " + err.Error() + "\n\n"
+			continue
 		}
-		res += "\n" + buildEditURL(parseList(v.Value)) + "\n\n"
+		if cond := rec.Options["condition"]; cond != "" {
+			res += "\nNotify when: " + cond
+		}
+		if channel := rec.Options["notifyname"]; channel != "" {
+			res += "\nNotifications go to " + channel
+		}
+		res += "\n" + buildEditURL(rec) + "\n\n"
 	}
 	return res
 }
 
-func sendInitialValue(uid int64, record []string) {
+func sendInitialValue(uid int64, record *Record, group bool, replyTo int) {
 	val := ""
 	cellval, err := cellValueByRecord(record)
 	if err == nil && cellval != nil {
-		val = "\nInitial value: '" + *cellval + "'"
+		val = "\nInitial value: '" + displayValue(*cellval) + "'"
 	}
-	messageChan <- makeMessage(uid, "New cell added!"+val, MENU_KB)
+	msg := makeMessage(uid, "New cell added!"+val, MENU_KB)
+	replyInGroup(msg, group, replyTo)
+	messageChan <- msg
 }
 
-func cellValueByRecord(record []string) (*string, error) {
-	val := getTable(record[0])
-	if val == nil {
-		return nil, nil
+func cellValueByRecord(record *Record) (*string, error) {
+	_, sheet, err := recordSource(record)
+	if sheet == nil {
+		return nil, err
 	}
-	if record[2] == "tabs" {
-		return getPageListString(*val), nil
+	return valueFromSheet(record, sheet)
+}
+
+func valueFromSheet(record *Record, sheet *Sheet) (*string, error) {
+	if record.Kind == KIND_TABS {
+		return getTabsValue(sheet), nil
+	}
+	if record.Kind == KIND_LOOKUP {
+		res, err := lookupCell(sheet, record.Gid, record.Options["header"], record.Options["keycol"], record.Options["keyval"])
+		return &res, err
+	}
+	if record.Kind == KIND_TABLE {
+		table, err := extractTable(sheet, record.Gid, record.Row1, record.Col1, record.Col2, record.Options["key"])
+		if err != nil {
+			return nil, err
+		}
+		res := table.Encode()
+		return &res, nil
 	}
-	res, err := extractCellValue(*val, record[1], record[3], record[2], record[5], record[4])
+	res, err := extractCellValue(sheet, record.Gid, record.Row1, record.Col1, record.Row2, record.Col2)
 	return &res, err
 }
 
-func sendPageList(uid int64, name string) {
-	table := getTable(name)
-
-	if table == nil {
-		state[uid]["name"] = "add"
-		messageChan <- makeMessage(uid, "Could not fetch the table, try again", []string{"Cancel"})
+// sendPageList fetches the table in the background and moves the dialog on to the tab or cell selection.
+// If the user has left the "add-page" step while the table was being fetched, the result is dropped.
+func sendPageList(db Storage, uid int64, record string) {
+	rec, err := decodeRecord(record)
+	if err != nil {
 		return
 	}
-	names, gids := getPageList(*table)
-	if names == nil {
-		state[uid]["name"] = "add"
-		messageChan <- makeMessage(uid, "Invalid table, try again", []string{"Cancel"})
-		return
+	sheet, err := getTabList(rec)
+	var msg *tgbotapi.MessageConfig
+	withState(db, uid, func(ustate map[string]string) {
+		if ustate["name"] != "add-page" || ustate["record"] != record {
+			return
+		}
+		group, replyTo := stateReply(ustate)
+		defer func() {
+			replyInGroup(msg, group, replyTo)
+		}()
+		ctx := &dialogContext{db: db, id: uid, group: group, state: ustate}
+		if sheet == nil && err == nil {
+			msg = makeMessage(uid, "Could not fetch the table, try again", []string{"Cancel"})
+			ustate["name"] = "add"
+			return
+		}
+		names, gids := getPageList(sheet)
+		if names == nil {
+			msg = makeMessage(uid, "Invalid table, try again", []string{"Cancel"})
+			ustate["name"] = "add"
+			return
+		}
+		if len(names) == 1 {
+			rec.Gid = gids[0]
+			ctx.setRecord(rec)
+			msg = mainDialog.enter(ctx, "add-cell")
+			return
+		}
+		text := "Send the number of the tab, or a range on any tab like 'Sheet 2'!A1:B3. Available tabs:\n"
+		for i, tabname := range names {
+			text += "\n" + strconv.Itoa(i+1) + ". " + tabname
+		}
+		msg = makeMessage(uid, text, mainDialog.steps["add-page"].keyboard)
+	})
+	if msg != nil {
+		messageChan <- msg
 	}
-	if len(names) == 1 {
-		data := parseList(state[uid]["record"])
-		data[1] = gids[0]
-		cdata, _ := json.Marshal(data)
-		state[uid]["record"] = string(cdata)
-		state[uid]["name"] = "add-cell"
-		messageChan <- makeMessage(uid, "What cell do you want to monitor?\nExamples: A1, A1:B5", []string{"Cancel", TABS_STR})
-		return
+}
+
+// saveNewRecord stores the record built by the add dialog under the name chosen by the user.
+func saveNewRecord(ctx *dialogContext, rec *Record) (string, error) {
+	name := ctx.state["record-name"]
+	if ctx.db.RecordExists(ctx.id, name) {
+		return ctx.fail("This name is already used")
 	}
-	msg := "Send the number of the tab. Available tabs:\n"
-	for i, tabname := range names {
-		msg += "\n" + strconv.Itoa(i+1) + ". " + tabname
+	rec.CreatedAt = time.Now()
+	ctx.db.DeleteCellVal(ctx.id, name)
+	ctx.db.DeleteHistory(ctx.id, name)
+	group, replyTo := stateReply(ctx.state)
+	go sendInitialValue(ctx.id, rec, group, replyTo)
+	ctx.db.AddRecord(ctx.id, name, rec.Encode())
+	return "", nil
+}
+
+// saveEditedRecord replaces the record being edited. Its old values do not apply to the new range.
+func saveEditedRecord(ctx *dialogContext, rec *Record) (string, error) {
+	name := ctx.state["record-name"]
+	delete(ctx.state, "editing")
+	ctx.db.DeleteCellVal(ctx.id, name)
+	ctx.db.DeleteHistory(ctx.id, name)
+	group, replyTo := stateReply(ctx.state)
+	go sendInitialValue(ctx.id, rec, group, replyTo)
+	ctx.db.DeleteRecord(ctx.id, name)
+	ctx.db.AddRecord(ctx.id, name, rec.Encode())
+	return "", nil
+}
+
+// rangeChosen continues the dialog once the range of the record is known:
+// an edited record is saved, a new one needs a name.
+func rangeChosen(ctx *dialogContext, rec *Record) (string, error) {
+	if ctx.state["editing"] != "" {
+		return saveEditedRecord(ctx, rec)
 	}
-	messageChan <- makeMessage(uid, msg, []string{"Cancel", TABS_STR})
+	ctx.setRecord(rec)
+	return "add-name", nil
 }
 
-func handle(id int64, message string) *tgbotapi.MessageConfig {
-	ustate, ok := state[id]
+// chooseRange sets the range in the message and continues with rangeChosen.
+// A range on another tab is looked up in the background.
+func chooseRange(ctx *dialogContext, rec *Record) (string, error) {
+	tab, err := parseRange(rec, ctx.message)
+	if err != nil {
+		return "", err
+	}
+	if tab == "" {
+		return rangeChosen(ctx, rec)
+	}
+	return checkInBackground(ctx, rec, func(rec *Record) error {
+		return moveToTab(rec, tab)
+	}, rangeChosen)
+}
+
+// checkLookup makes sure the lookup finds its cell, if the table can be read at all.
+func checkLookup(rec *Record) error {
+	if sheet, _ := getTabList(rec); sheet != nil && sheet.Tab(rec.Gid) != nil && sheet.Tab(rec.Gid).Cells != nil {
+		if _, err := valueFromSheet(rec, sheet); err != nil {
+			return errors.New(err.Error() + ", try again.")
+		}
+	}
+	return nil
+}
+
+// checkInBackground runs check, which may fetch the document, outside of the update loop,
+// so that a slow fetch does not hold up the other chats. Meanwhile the dialog waits in the
+// "checking" step. Then it goes on with done, or returns to the current step if check fails.
+// If the user has left the dialog in the meantime, the result is dropped.
+func checkInBackground(ctx *dialogContext, rec *Record, check func(rec *Record) error,
+	done func(ctx *dialogContext, rec *Record) (string, error)) (string, error) {
+	db, uid, from, record := ctx.db, ctx.id, ctx.state["name"], rec.Encode()
+	ctx.state["checking"] = record
+	go func() {
+		err := check(rec)
+		var msg *tgbotapi.MessageConfig
+		withState(db, uid, func(ustate map[string]string) {
+			if ustate["name"] != "checking" || ustate["checking"] != record {
+				return
+			}
+			delete(ustate, "checking")
+			group, replyTo := stateReply(ustate)
+			defer func() {
+				replyInGroup(msg, group, replyTo)
+			}()
+			if err != nil {
+				ustate["name"] = from
+				msg = makeMessage(uid, err.Error(), mainDialog.steps[from].keyboard)
+				return
+			}
+			ctx := &dialogContext{db: db, id: uid, group: group, state: ustate}
+			next, err := done(ctx, rec)
+			if err != nil {
+				ustate["name"] = from
+				msg = makeMessage(uid, err.Error(), mainDialog.steps[from].keyboard)
+				return
+			}
+			msg = mainDialog.enter(ctx, next)
+		})
+		if msg != nil {
+			messageChan <- msg
+		}
+	}()
+	return "checking", nil
+}
+
+var mainDialog = newDialog()
+
+func init() {
+	mainDialog.register("", &step{
+		keyboard: MENU_KB,
+		handle: func(ctx *dialogContext) (string, error) {
+			switch ctx.message {
+			case MENU_KB[0]:
+				if !ctx.isAdmin() {
+					ctx.reply = makeMessage(ctx.id, errNotAdmin.Error(), MENU_KB)
+					return "", nil
+				}
+				return "add", nil
+			case MENU_KB[1]:
+				pairs := ctx.db.RecordList(ctx.id)
+				text := formatRecordList(ctx.db, ctx.id, pairs)
+				if shared := formatSubscriptions(ctx.db, ctx.id); shared != "" {
+					text += "\n\n" + shared
+				}
+				ctx.reply = makeMessageInline(ctx.id, text, []string{"Edit", "Delete"})
+				return "", nil
+			}
+			return "", errors.New("Wat?")
+		},
+	})
+	mainDialog.register("add", &step{
+		prompt: staticPrompt("Enter the cell URL. You can get it by right-clicking the cell and copying the link to it. " +
+			"You may also just paste the table URL here and select the cell later."),
+		keyboard: []string{"Cancel"},
+		handle: func(ctx *dialogContext) (string, error) {
+			rec := parseURL(ctx.message)
+			if rec == nil {
+				return "", errors.New("Invalid url, try again.")
+			}
+			delete(ctx.state, "editing")
+			ctx.setRecord(rec)
+			if !rec.HasRange() {
+				go sendPageList(ctx.db, ctx.id, ctx.state["record"])
+				return "add-page", nil
+			}
+			return "add-name", nil
+		},
+	})
+	mainDialog.register("add-page", &step{
+		keyboard: []string{"Cancel", TABS_STR},
+		handle: func(ctx *dialogContext) (string, error) {
+			if ctx.message == TABS_STR {
+				return mainDialog.steps["add-cell"].handle(ctx)
+			}
+			if tab, _, _, _, _, ok := parseA1(ctx.message); ok && tab != "" {
+				return mainDialog.steps["add-cell"].handle(ctx)
+			}
+			number, err := strconv.ParseInt(ctx.message, 10, 64)
+			if err != nil || number <= 0 {
+				return "", errors.New("Bad number, try again")
+			}
+			rec, err := ctx.record()
+			if err != nil {
+				return ctx.fail("Something went wrong")
+			}
+			sheet, err := getTabList(rec)
+			if sheet == nil && err == nil {
+				return "", errors.New("Could not fetch table, try again")
+			}
+			_, gids := getPageList(sheet)
+			if number > int64(len(gids)) {
+				return "", errors.New("Bad number, try again")
+			}
+			rec.Gid = gids[number-1]
+			ctx.setRecord(rec)
+			return "add-cell", nil
+		},
+	})
+	mainDialog.register("add-cell", &step{
+		prompt:   staticPrompt("What cell do you want to monitor?\nExamples: A1, A1:B5, C:C, 3:3, A2:A, 'Sheet 2'!A1:B3"),
+		keyboard: []string{"Cancel", TABS_STR, TABLE_STR, LOOKUP_STR},
+		handle: func(ctx *dialogContext) (string, error) {
+			if ctx.message == TABLE_STR {
+				return "add-table", nil
+			}
+			if ctx.message == LOOKUP_STR {
+				return "add-lookup", nil
+			}
+			rec, err := ctx.record()
+			if err != nil {
+				return ctx.fail("Something went wrong")
+			}
+			return chooseRange(ctx, rec)
+		},
+	})
+	mainDialog.register("checking", &step{
+		keyboard: []string{"Cancel"},
+		handle: func(ctx *dialogContext) (string, error) {
+			return "", errors.New("Still looking at the table, wait a moment")
+		},
+	})
+	mainDialog.register("add-table", &step{
+		prompt:   staticPrompt("Which columns contain the rows?\nExamples: A:D, A2:D to skip the first row"),
+		keyboard: []string{"Cancel"},
+		handle: func(ctx *dialogContext) (string, error) {
+			rec, err := ctx.record()
+			if err != nil {
+				return ctx.fail("Something went wrong")
+			}
+			parsed := TABLE_RE.FindStringSubmatch(strings.ToUpper(ctx.message))
+			if len(parsed) != 4 {
+				return "", errors.New("Invalid columns, try again.")
+			}
+			rec.SetTable(parsed[1], parsed[2], parsed[3])
+			ctx.setRecord(rec)
+			return "add-key", nil
+		},
+	})
+	mainDialog.register("add-key", &step{
+		prompt:   staticPrompt("Which column identifies a row? For example, the column with order numbers"),
+		keyboard: []string{"Cancel"},
+		handle: func(ctx *dialogContext) (string, error) {
+			rec, err := ctx.record()
+			if err != nil {
+				return ctx.fail("Something went wrong")
+			}
+			key := strings.ToUpper(ctx.message)
+			col, col1, col2 := colToInt(key), colToInt(rec.Col1), colToInt(rec.Col2)
+			if col1 > col2 {
+				col1, col2 = col2, col1
+			}
+			if !COLUMN_RE.MatchString(key) || col < col1 || col > col2 {
+				return "", errors.New("Enter a column between " + rec.Col1 + " and " + rec.Col2 + ", try again.")
+			}
+			rec.SetOption("key", key)
+			return rangeChosen(ctx, rec)
+		},
+	})
+	mainDialog.register("add-lookup", &step{
+		prompt: staticPrompt("Send the title of the column and the row to look for, like\nStatus, A = Order 42\n" +
+			"I will watch the cell in the column titled Status and in the row where column A is Order 42, even if they move."),
+		keyboard: []string{"Cancel"},
+		handle: func(ctx *dialogContext) (string, error) {
+			rec, err := ctx.record()
+			if err != nil {
+				return ctx.fail("Something went wrong")
+			}
+			parsed := LOOKUP_RE.FindStringSubmatch(ctx.message)
+			if len(parsed) != 4 {
+				return "", errors.New("Invalid format, try again.")
+			}
+			rec.SetLookup(parsed[1], strings.ToUpper(parsed[2]), parsed[3])
+			return checkInBackground(ctx, rec, checkLookup, rangeChosen)
+		},
+	})
+	mainDialog.register("add-name", &step{
+		prompt:   staticPrompt("Enter the name for this cell"),
+		keyboard: []string{"Cancel"},
+		handle: func(ctx *dialogContext) (string, error) {
+			if len(ctx.message) == 0 {
+				return "", errors.New("Bad name, try again")
+			}
+			if ctx.db.RecordExists(ctx.id, ctx.message) {
+				return "", errors.New("This name is already used, try again")
+			}
+			rec, err := ctx.record()
+			if err != nil {
+				return ctx.fail("Something went wrong")
+			}
+			ctx.state["record-name"] = ctx.message
+			if rec.Kind == KIND_TABS || rec.Kind == KIND_TABLE {
+				return saveNewRecord(ctx, rec)
+			}
+			return "add-condition", nil
+		},
+	})
+	mainDialog.register("add-condition", &step{
+		prompt: func(ctx *dialogContext) string {
+			if rec, err := ctx.record(); err == nil && !rec.HasNumber() {
+				return RANGE_CONDITION_HELP
+			}
+			return CONDITION_HELP
+		},
+		keyboard: []string{"Cancel", "Any change"},
+		handle: func(ctx *dialogContext) (string, error) {
+			cond, err := parseCondition(ctx.message)
+			if err != nil {
+				return "", errors.New(err.Error() + ", try again")
+			}
+			rec, err := ctx.record()
+			if err != nil {
+				return ctx.fail("Something went wrong")
+			}
+			if cond.IsNumeric() && !rec.HasNumber() {
+				return "", errors.New("Numbers can only be compared for a single cell, try again")
+			}
+			if cond.Op != COND_ANY {
+				rec.SetOption("condition", cond.String())
+			}
+			return saveNewRecord(ctx, rec)
+		},
+	})
+	mainDialog.register("delete", &step{
+		prompt: staticPrompt("Which cells do you want to delete?\n" +
+			"Enter their numbers separated by commas or spaces"),
+		keyboard: []string{"Cancel"},
+		handle: func(ctx *dialogContext) (string, error) {
+			numbers := strings.Split(strings.Replace(ctx.message, ",", " ", -1), " ")
+			ints := make([]int64, 0)
+			pairs := ctx.db.RecordList(ctx.id)
+			for _, val := range numbers {
+				if val == "" {
+					continue
+				}
+				res, err := strconv.ParseInt(val, 10, 64)
+				if err != nil || res <= 0 || res > int64(len(pairs)) {
+					return "", errors.New("Bad number, try again")
+				}
+				ints = append(ints, res)
+			}
+			for _, num := range ints {
+				code := ""
+				if rec, err := decodeRecord(pairs[num-1].Value); err == nil {
+					code = rec.Options["share"]
+				}
+				dropShare(ctx.db, ctx.id, pairs[num-1].Name, code)
+				ctx.db.DeleteRecord(ctx.id, pairs[num-1].Name)
+				ctx.db.DeleteCellVal(ctx.id, pairs[num-1].Name)
+				ctx.db.DeleteHistory(ctx.id, pairs[num-1].Name)
+			}
+			ctx.reply = makeMessage(ctx.id, "Deleted!", MENU_KB)
+			return "", nil
+		},
+	})
+	mainDialog.register("edit", &step{
+		prompt:   staticPrompt("Which cell do you want to edit? Enter its number"),
+		keyboard: []string{"Cancel"},
+		handle: func(ctx *dialogContext) (string, error) {
+			pairs := ctx.db.RecordList(ctx.id)
+			num, err := strconv.ParseInt(ctx.message, 10, 64)
+			if err != nil || num <= 0 || num > int64(len(pairs)) {
+				return "", errors.New("Bad number, try again")
+			}
+			rec, err := decodeRecord(pairs[num-1].Value)
+			if err != nil {
+				return ctx.fail("This record is broken, delete it and add again")
+			}
+			ctx.state["record-name"] = pairs[num-1].Name
+			ctx.state["editing"] = "1"
+			ctx.setRecord(rec)
+			return "edit-cell", nil
+		},
+	})
+	mainDialog.register("edit-cell", &step{
+		prompt: func(ctx *dialogContext) string {
+			text := "What cell do you want to monitor?"
+			if rec, err := ctx.record(); err == nil {
+				text += "\nCurrently: " + rec.RangeString()
+			}
+			return text
+		},
+		keyboard: []string{"Cancel", TABS_STR, TABLE_STR, LOOKUP_STR},
+		handle: func(ctx *dialogContext) (string, error) {
+			if ctx.message == TABLE_STR {
+				return "add-table", nil
+			}
+			if ctx.message == LOOKUP_STR {
+				return "add-lookup", nil
+			}
+			rec, err := ctx.record()
+			if err != nil {
+				return ctx.fail("Something went wrong")
+			}
+			return chooseRange(ctx, rec)
+		},
+	})
+}
+
+// HISTORY_LENGTH is the number of changes shown by /history.
+const HISTORY_LENGTH = 10
+
+// formatHistory handles "/history <name>" and returns the reply.
+func formatHistory(db Storage, id int64, name string) string {
+	if !db.RecordExists(id, name) {
+		return "No cell named " + name
+	}
+	history := db.History(id, name)
+	if len(history) == 0 {
+		return "No changes of " + name + " yet"
+	}
+	if len(history) > HISTORY_LENGTH {
+		history = history[len(history)-HISTORY_LENGTH:]
+	}
+	res := "Last changes of " + name + ":\n"
+	for i := len(history) - 1; i >= 0; i-- {
+		res += "\n" + history[i].Time.Format("2006-01-02 15:04") + " '" + displayValue(history[i].Value) + "'"
+	}
+	return res
+}
+
+// sendChart handles "/chart <name>". The chart is sent as a photo, and a reply is
+// returned only if there is nothing to draw. Only single cells have a number to draw.
+func sendChart(db Storage, id int64, name string) *tgbotapi.MessageConfig {
+	value, ok := db.GetRecord(id, name)
+	if !ok {
+		return makeMessage(id, "No cell named "+name, MENU_KB)
+	}
+	if rec, err := decodeRecord(value); err != nil || !rec.HasNumber() {
+		return makeMessage(id, "Charts can only be drawn for a single cell", MENU_KB)
+	}
+	points := numericHistory(db.History(id, name))
+	data, err := drawChart(points, time.Now())
+	if err != nil {
+		return makeMessage(id, "Cannot draw "+name+": "+err.Error(), MENU_KB)
+	}
+	photo := tgbotapi.NewPhotoUpload(id, tgbotapi.FileBytes{Name: "chart.png", Bytes: data})
+	photo.Caption = chartCaption(name, points)
+	photoChan <- photo
+	return nil
+}
+
+// setNotify handles "/notify <channel>|off <name>" and returns the reply.
+func setNotify(db Storage, id int64, user int, args string) string {
+	parts := strings.SplitN(strings.Trim(args, " "), " ", 2)
+	if len(parts) != 2 {
+		return "Usage: /notify @channel|off <name>"
+	}
+	target, name := parts[0], strings.Trim(parts[1], " ")
+	value, ok := db.GetRecord(id, name)
+	if !ok {
+		return "No cell named " + name
+	}
+	rec, err := decodeRecord(value)
+	if err != nil {
+		return "This record is broken, delete it and add again"
+	}
+	if target == "off" {
+		delete(rec.Options, "notify")
+		delete(rec.Options, "notifyname")
+	} else {
+		chat, err := resolveChannel(target, user)
+		if err != nil {
+			return err.Error()
+		}
+		rec.SetOption("notify", strconv.FormatInt(chat.ID, 10))
+		rec.SetOption("notifyname", target)
+		// resolveChannel has checked that the bot can post there again
+		db.SetInactive(chat.ID, false)
+	}
+	db.AddRecord(id, name, rec.Encode())
+	return "Ok"
+}
+
+// setFetchMode handles "/fetch <mode> <name>" and returns the reply.
+func setFetchMode(db Storage, id int64, args string) string {
+	parts := strings.SplitN(strings.Trim(args, " "), " ", 2)
+	if len(parts) != 2 {
+		return "Usage: /fetch html|csv|api|auto|default <name>"
+	}
+	mode, name := parts[0], strings.Trim(parts[1], " ")
+	if mode != FETCH_HTML && mode != FETCH_CSV && mode != FETCH_API && mode != FETCH_AUTO && mode != "default" {
+		return "Unknown mode " + mode
+	}
+	value, ok := db.GetRecord(id, name)
 	if !ok {
-		state[id] = make(map[string]string)
-		ustate = state[id]
+		return "No cell named " + name
 	}
+	rec, err := decodeRecord(value)
+	if err != nil {
+		return "This record is broken, delete it and add again"
+	}
+	if mode == "default" {
+		delete(rec.Options, "fetch")
+	} else {
+		rec.SetOption("fetch", mode)
+	}
+	db.AddRecord(id, name, rec.Encode())
+	return "Ok"
+}
+
+func handle(db Storage, m *chatMessage) (res *tgbotapi.MessageConfig) {
+	text, ok := stripBotName(m.text)
+	if !ok {
+		return nil
+	}
+	withState(db, m.chat, func(ustate map[string]string) {
+		user := strconv.Itoa(m.user)
+		if m.group {
+			owner := ustate["name"] != "" && ustate["user"] == user
+			menu := ustate["name"] == "" && (text == MENU_KB[0] || text == MENU_KB[1])
+			if !owner && !menu && !strings.HasPrefix(text, "/") {
+				return
+			}
+			if !mayInterrupt(ustate, m) {
+				// The command is answered on a copy, so that the dialog of another user goes on
+				ustate = copyState(ustate)
+			}
+			ustate["group"] = "1"
+			ustate["reply"] = strconv.Itoa(m.id)
+			// Buttons are typed in groups
+			text = stepOption(ustate["name"], text)
+		}
+		ustate["user"] = user
+		ctx := &dialogContext{db: db, id: m.chat, user: m.user, group: m.group, message: strings.Trim(text, " "), state: ustate}
+		res = handleMessage(ctx, text)
+		replyInGroup(res, m.group, m.id)
+	})
+	return
+}
+
+// MENU_COMMANDS do the same as the menu buttons. They are needed in groups,
+// where the bot does not see the button presses.
+var MENU_COMMANDS = map[string]string{"/add": MENU_KB[0], "/list": MENU_KB[1]}
+
+// stepOption returns the button of the step that matches the typed text, ignoring the case.
+// Other texts are returned as they are.
+func stepOption(name string, text string) string {
+	if s := mainDialog.steps[name]; s != nil {
+		for _, option := range s.keyboard {
+			if strings.EqualFold(strings.Trim(text, " "), option) {
+				return option
+			}
+		}
+	}
+	return text
+}
+
+// shareCommands take the name of a record and change who gets its notifications.
+var shareCommands = map[string]func(db Storage, id int64, name string) string{
+	"/share":       shareRecord,
+	"/unshare":     unshareRecord,
+	"/unsubscribe": unsubscribe,
+}
+
+func handleMessage(ctx *dialogContext, message string) *tgbotapi.MessageConfig {
+	db, id, ustate := ctx.db, ctx.id, ctx.state
 	if message == "/start" {
 		ustate["name"] = ""
 		return makeMessage(id, "Hello!", MENU_KB)
 	}
+	if strings.HasPrefix(message, "/start ") {
+		ustate["name"] = ""
+		if !ctx.isAdmin() {
+			return makeMessage(id, errNotAdmin.Error(), MENU_KB)
+		}
+		return makeMessage(id, subscribe(db, id, strings.Trim(strings.TrimPrefix(message, "/start "), " ")), MENU_KB)
+	}
+	if command, ok := MENU_COMMANDS[message]; ok {
+		ustate["name"] = ""
+		ctx.message = command
+		return mainDialog.run(ctx)
+	}
 	if message == "/help" {
 		ustate["name"] = ""
 		return makeMessage(id, HELP_STR, MENU_KB)
@@ -136,195 +735,73 @@ func handle(id int64, message string) *tgbotapi.MessageConfig {
 		ustate["name"] = ""
 		return makeMessage(id, "Ok", MENU_KB)
 	}
-	switch ustate["name"] {
-	case "":
-		switch message {
-		case MENU_KB[0]:
-			ustate["name"] = "add"
-			return makeMessage(id, "Enter the cell URL. You can get it by right-clicking the cell and copying the link to it. "+
-				"You may also just paste the table URL here and select the cell later.", []string{"Cancel"})
-		case MENU_KB[1]:
-			pairs := recordList(id)
-			return makeMessageInline(id, formatRecordList(id, pairs), []string{"Edit", "Delete"})
-		default:
-			return makeMessage(id, "Wat?", MENU_KB)
-		}
-	case "add":
-		message = strings.Trim(message, " ")
-		parsed := parseURL(message)
-		if len(parsed) != DATA_LENGTH {
-			return makeMessage(id, "Invalid url, try again.", []string{"Cancel"})
-		}
-		data, err := json.Marshal(parsed)
-		if err != nil {
-			return makeMessage(id, "Something went wrong", []string{"Cancel"})
-		}
-		ustate["record"] = string(data)
-		if parsed[2] == "" {
-			ustate["name"] = "add-page"
-			go sendPageList(id, parsed[0])
-			return nil
-		}
-		ustate["name"] = "add-name"
-		return makeMessage(id, "Enter the name for this cell", []string{"Cancel"})
-	case "add-page":
-		if message != TABS_STR {
-			message = strings.Trim(message, " ")
-			number, err := strconv.ParseInt(message, 10, 64)
-			if err != nil || number < 0 {
-				return makeMessage(id, "Bad number, try again", []string{"Cancel"})
-			}
-			data := parseList(ustate["record"])
-			table := getTable(data[0])
-			if table == nil {
-				return makeMessage(id, "Could not fetch table, try again", []string{"Cancel"})
-			}
-			_, gids := getPageList(*table)
-			if number > int64(len(gids)) {
-				return makeMessage(id, "Bad number, try again", []string{"Cancel"})
-			}
-			data[1] = gids[number-1]
-			cdata, _ := json.Marshal(data)
-			ustate["record"] = string(cdata)
-			ustate["name"] = "add-cell"
-			return makeMessage(id, "What cell do you want to monitor?\nExamples: A1, A1:B5", []string{"Cancel", TABS_STR})
-		}
-		fallthrough
-	case "add-cell":
-		var parsed []string
-		if message == TABS_STR {
-			parsed = make([]string, 0)
-			parsed = append(parsed, "", "tabs", "", "", "")
-		} else {
-			message = strings.ToUpper(strings.Trim(message, " "))
-			parsed = CELL_RE.FindStringSubmatch(message)
-			if len(parsed) != 5 {
-				return makeMessage(id, "Invalid cell, try again.", []string{"Cancel"})
-			}
-		}
-		data := parseList(ustate["record"])
-		data[2] = parsed[1]
-		data[3] = parsed[2]
-		data[4] = parsed[3]
-		data[5] = parsed[4]
-		if data[4] == "" {
-			data[4] = data[2]
-		}
-		if data[5] == "" {
-			data[5] = data[3]
-		}
-		cdata, _ := json.Marshal(data)
-		ustate["record"] = string(cdata)
-		ustate["name"] = "add-name"
-		return makeMessage(id, "Enter the name for this cell", []string{"Cancel"})
-	case "add-name":
-		message = strings.Trim(message, " ")
-		if len(message) == 0 {
-			return makeMessage(id, "Bad name, try again", []string{"Cancel"})
-		}
-		if recordExists(id, message) {
-			return makeMessage(id, "This name is already used, try again", []string{"Cancel"})
-		}
-		deleteCellVal(id, message)
-		go sendInitialValue(id, parseList(ustate["record"]))
-		addRecord(id, message, ustate["record"])
+	if strings.HasPrefix(message, "/history ") {
 		ustate["name"] = ""
-		return nil
-	case "delete":
-		message = strings.Trim(message, " ")
-		numbers := strings.Split(strings.Replace(message, ",", " ", -1), " ")
-		ints := make([]int64, 0)
-		pairs := recordList(id)
-		for _, val := range numbers {
-			if val == "" {
-				continue
-			}
-			res, err := strconv.ParseInt(val, 10, 64)
-			if err != nil || res <= 0 || res > int64(len(pairs)) {
-				return makeMessage(id, "Bad number, try again", []string{"Cancel"})
-			}
-			ints = append(ints, res)
-		}
-		for _, num := range ints {
-			deleteRecord(id, pairs[num-1].Name)
-			deleteCellVal(id, pairs[num-1].Name)
-		}
+		return makeMessage(id, formatHistory(db, id, strings.Trim(strings.TrimPrefix(message, "/history "), " ")), MENU_KB)
+	}
+	if strings.HasPrefix(message, "/chart ") {
 		ustate["name"] = ""
-		return makeMessage(id, "Deleted!", MENU_KB)
-	case "edit":
-		message = strings.Trim(message, " ")
-		pairs := recordList(id)
-		num, err := strconv.ParseInt(message, 10, 64)
-		if err != nil || num <= 0 || num > int64(len(pairs)) {
-			return makeMessage(id, "Bad number, try again", []string{"Cancel"})
-		}
-		ustate["record-name"] = pairs[num-1].Name
-		ustate["record"] = pairs[num-1].Value
-		ustate["name"] = "edit-cell"
-		plist := parseList(ustate["record"])
-		currentCell := plist[2] + plist[3]
-		if plist[4] != plist[2] || plist[5] != plist[3] {
-			currentCell += ":" + plist[4] + plist[5]
+		return sendChart(db, id, strings.Trim(strings.TrimPrefix(message, "/chart "), " "))
+	}
+	if strings.HasPrefix(message, "/fetch ") {
+		ustate["name"] = ""
+		if !ctx.isAdmin() {
+			return makeMessage(id, errNotAdmin.Error(), MENU_KB)
 		}
-		return makeMessage(id, "What cell do you want to monitor?\nCurrently: "+currentCell, []string{"Cancel", TABS_STR})
-	case "edit-cell":
-		var parsed []string
-		if message == TABS_STR {
-			parsed = make([]string, 0)
-			parsed = append(parsed, "", "tabs", "", "", "")
-		} else {
-			message = strings.ToUpper(strings.Trim(message, " "))
-			parsed = CELL_RE.FindStringSubmatch(message)
-			if len(parsed) != 5 {
-				return makeMessage(id, "Invalid cell, try again.", []string{"Cancel"})
+		return makeMessage(id, setFetchMode(db, id, strings.TrimPrefix(message, "/fetch ")), MENU_KB)
+	}
+	for command, fn := range shareCommands {
+		if strings.HasPrefix(message, command+" ") {
+			ustate["name"] = ""
+			if !ctx.isAdmin() {
+				return makeMessage(id, errNotAdmin.Error(), MENU_KB)
 			}
+			return makeMessage(id, fn(db, id, strings.Trim(strings.TrimPrefix(message, command+" "), " ")), MENU_KB)
 		}
-		data := parseList(ustate["record"])
-		data[2] = parsed[1]
-		data[3] = parsed[2]
-		data[4] = parsed[3]
-		data[5] = parsed[4]
-		if data[4] == "" {
-			data[4] = data[2]
-		}
-		if data[5] == "" {
-			data[5] = data[3]
-		}
-		cdata, _ := json.Marshal(data)
-		deleteCellVal(id, ustate["record-name"])
-		go sendInitialValue(id, data)
-		deleteRecord(id, ustate["record-name"])
-		addRecord(id, ustate["record-name"], string(cdata))
+	}
+	if strings.HasPrefix(message, "/notify ") {
 		ustate["name"] = ""
+		if !ctx.isAdmin() {
+			return makeMessage(id, errNotAdmin.Error(), MENU_KB)
+		}
+		return makeMessage(id, setNotify(db, id, ctx.user, strings.TrimPrefix(message, "/notify ")), MENU_KB)
+	}
+	if ctx.group && strings.HasPrefix(message, "/") {
+		// Other commands are meant for other bots in the group
 		return nil
 	}
-	return makeMessage(id, "Not implemented yet", MENU_KB)
+	return mainDialog.run(ctx)
 }
 
-func handleCallback(id int64, data string) *tgbotapi.MessageConfig {
-	ustate, ok := state[id]
-	if !ok {
-		state[id] = make(map[string]string)
-		ustate = state[id]
-	}
-	if data == "Delete" {
-		pairs := recordList(id)
-		if len(pairs) == 0 {
+func handleCallback(db Storage, m *chatMessage) (res *tgbotapi.MessageConfig) {
+	withState(db, m.chat, func(ustate map[string]string) {
+		if m.group {
+			if !mayInterrupt(ustate, m) {
+				ustate = copyState(ustate)
+			}
+			ustate["group"] = "1"
+			delete(ustate, "reply")
+		}
+		ustate["user"] = strconv.Itoa(m.user)
+		ctx := &dialogContext{db: db, id: m.chat, user: m.user, group: m.group, message: m.text, state: ustate}
+		res = handleCallbackData(ctx)
+		replyInGroup(res, m.group, 0)
+	})
+	return
+}
+
+func handleCallbackData(ctx *dialogContext) *tgbotapi.MessageConfig {
+	db, id, data, ustate := ctx.db, ctx.id, ctx.message, ctx.state
+	if data == "Delete" || data == "Edit" {
+		if len(db.RecordList(id)) == 0 {
 			ustate["name"] = ""
 			return makeMessage(id, "You have no cells yet", MENU_KB)
 		}
-		ustate["name"] = "delete"
-		return makeMessage(id, "Which cells do you want to delete?\n"+
-			"Enter their numbers separated by commas or spaces", []string{"Cancel"})
-	}
-	if data == "Edit" {
-		pairs := recordList(id)
-		if len(pairs) == 0 {
+		if !ctx.isAdmin() {
 			ustate["name"] = ""
-			return makeMessage(id, "You have no cells yet", MENU_KB)
+			return makeMessage(id, errNotAdmin.Error(), MENU_KB)
 		}
-		ustate["name"] = "edit"
-		return makeMessage(id, "Which cell do you want to edit? Enter its number", []string{"Cancel"})
+		return mainDialog.enter(ctx, strings.ToLower(data))
 	}
 	return makeMessage(id, "Not implemented yet", MENU_KB)
 }
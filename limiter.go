@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	// GLOBAL_SEND_INTERVAL keeps the bot below 30 messages per second.
+	GLOBAL_SEND_INTERVAL = time.Second / 30
+	// CHAT_SEND_INTERVAL is the pause between messages to the same private chat.
+	CHAT_SEND_INTERVAL = time.Second
+	// GROUP_SEND_INTERVAL is the pause between messages to the same group, which allows 20 messages per minute.
+	GROUP_SEND_INTERVAL = 3 * time.Second
+	// SEND_ATTEMPTS is how many times a message is sent before giving up.
+	SEND_ATTEMPTS = 5
+	// SEND_BACKOFF is the pause after the first network error. It doubles with every attempt.
+	SEND_BACKOFF = time.Second
+	// MAX_SEND_PAUSE limits the pause requested by Telegram.
+	MAX_SEND_PAUSE = time.Minute
+)
+
+// errChatPaused is returned instead of waiting until a message can be sent to the chat.
+var errChatPaused = errors.New("the chat cannot get messages yet")
+
+// rateLimiter spaces the requests to Telegram, both overall and for every chat.
+type rateLimiter struct {
+	lock sync.Mutex
+	// next is the earliest time of the next request.
+	next time.Time
+	// chats keeps the earliest time of the next message to every chat.
+	chats map[int64]time.Time
+}
+
+var limiter = rateLimiter{chats: make(map[int64]time.Time)}
+
+func chatInterval(chat int64) time.Duration {
+	if chat < 0 {
+		return GROUP_SEND_INTERVAL
+	}
+	return CHAT_SEND_INTERVAL
+}
+
+// reserve takes the slot of the next message to the chat and waits for the global limit.
+// If the chat cannot get messages yet, it returns false at once, so that the other chats are not held up.
+// Chat 0 is for requests that are not sent to a chat, they only count towards the global limit.
+func (l *rateLimiter) reserve(chat int64) bool {
+	l.lock.Lock()
+	now := time.Now()
+	if chat != 0 && l.chats[chat].After(now) {
+		l.lock.Unlock()
+		return false
+	}
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(GLOBAL_SEND_INTERVAL)
+	if chat != 0 {
+		l.chats[chat] = at.Add(chatInterval(chat))
+	}
+	if len(l.chats) > 1000 {
+		for id, t := range l.chats {
+			if t.Before(now) {
+				delete(l.chats, id)
+			}
+		}
+	}
+	l.lock.Unlock()
+	time.Sleep(at.Sub(now))
+	return true
+}
+
+// pause delays the next message to the chat, or every request if chat is 0.
+func (l *rateLimiter) pause(chat int64, d time.Duration) {
+	if d > MAX_SEND_PAUSE {
+		d = MAX_SEND_PAUSE
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	at := time.Now().Add(d)
+	if chat == 0 {
+		if at.After(l.next) {
+			l.next = at
+		}
+	} else if at.After(l.chats[chat]) {
+		l.chats[chat] = at
+	}
+}
+
+// TELEGRAM_ERROR_RE matches the descriptions of the errors Telegram answers with.
+var TELEGRAM_ERROR_RE = regexp.MustCompile(`^(Bad Request|Unauthorized|Forbidden|Not Found|Conflict|Too Many Requests)(:|$)`)
+
+var RETRY_AFTER_RE = regexp.MustCompile(`retry after (\d+)`)
+
+// apiError returns the answer of Telegram if the request got one. The library returns the answers
+// to uploads, e.g. photos, as plain errors with the description, so they are recognized by the text.
+func apiError(err error) (tgbotapi.Error, bool) {
+	if apiErr, ok := err.(tgbotapi.Error); ok {
+		return apiErr, true
+	}
+	if err == nil || !TELEGRAM_ERROR_RE.MatchString(err.Error()) {
+		return tgbotapi.Error{}, false
+	}
+	res := tgbotapi.Error{Message: err.Error()}
+	if m := RETRY_AFTER_RE.FindStringSubmatch(res.Message); m != nil {
+		res.RetryAfter, _ = strconv.Atoi(m[1])
+	}
+	return res, true
+}
+
+// isBlocked reports whether the chat is not available to the bot anymore,
+// e.g. the user has blocked it or it was removed from the group.
+func isBlocked(err error) bool {
+	apiErr, ok := apiError(err)
+	return ok && strings.HasPrefix(apiErr.Message, "Forbidden")
+}
+
+// isNetworkError reports whether the request did not get a response from Telegram.
+func isNetworkError(err error) bool {
+	_, ok := apiError(err)
+	return err != nil && err != errChatPaused && !ok
+}
+
+// isRetryable reports whether the request may succeed if it is sent again later.
+// Telegram answers with a pause to wait for when it is only too busy, other answers are final.
+func isRetryable(err error) bool {
+	apiErr, ok := apiError(err)
+	return !ok || apiErr.RetryAfter != 0
+}
+
+// sendLimited calls send within the rate limits. If the chat has to wait, e.g. as long as
+// Telegram asks to, errChatPaused is returned and the caller tries again later. Network
+// errors are retried with a growing pause. Other errors are returned at once, as sending
+// the same request again would fail the same way.
+func sendLimited(chat int64, send func() error) error {
+	if !limiter.reserve(chat) {
+		return errChatPaused
+	}
+	backoff := SEND_BACKOFF
+	var err error
+	for attempt := 0; attempt < SEND_ATTEMPTS; attempt++ {
+		// The slot of the chat is taken once, the retries only wait for the global one
+		if attempt > 0 {
+			limiter.reserve(0)
+		}
+		if err = send(); err == nil {
+			return nil
+		}
+		if apiErr, ok := apiError(err); ok {
+			if apiErr.RetryAfter == 0 {
+				return err
+			}
+			log.Printf("Too many requests to %d, waiting %ds", chat, apiErr.RetryAfter)
+			limiter.pause(chat, time.Duration(apiErr.RetryAfter)*time.Second)
+			if chat != 0 {
+				return errChatPaused
+			}
+			continue
+		}
+		// The network is down for every chat
+		limiter.pause(0, backoff)
+		backoff *= 2
+	}
+	return err
+}
+
+// sendMessage sends a message to the chat. If the chat has blocked the bot, it is marked inactive
+// and the owners of the records notifying it are told.
+func sendMessage(bot *tgbotapi.BotAPI, db Storage, chat int64, c tgbotapi.Chattable) error {
+	err := sendLimited(chat, func() error {
+		_, err := bot.Send(c)
+		return err
+	})
+	if isBlocked(err) {
+		log.Printf("Chat %d is not available: %s", chat, err.Error())
+		db.SetInactive(chat, true)
+		reportInactiveTarget(db, chat)
+	}
+	return err
+}
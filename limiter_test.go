@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+func TestErrorKinds(t *testing.T) {
+	tests := []struct {
+		err       error
+		blocked   bool
+		network   bool
+		retryable bool
+	}{
+		{tgbotapi.Error{Message: "Forbidden: bot was blocked by the user"}, true, false, false},
+		{errors.New("Forbidden: bot was kicked from the group chat"), true, false, false},
+		{errors.New("Bad Request: chat not found"), false, false, false},
+		{tgbotapi.Error{Message: "Too Many Requests: retry after 5", ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 5}}, false, false, true},
+		{errors.New("Too Many Requests: retry after 5"), false, false, true},
+		{errors.New("Post https://api.telegram.org/bot/sendPhoto: dial tcp: i/o timeout"), false, true, true},
+	}
+	for _, test := range tests {
+		if isBlocked(test.err) != test.blocked || isNetworkError(test.err) != test.network || isRetryable(test.err) != test.retryable {
+			t.Errorf("%q: blocked %v, network %v, retryable %v", test.err, isBlocked(test.err), isNetworkError(test.err), isRetryable(test.err))
+		}
+	}
+	if apiErr, ok := apiError(errors.New("Too Many Requests: retry after 7")); !ok || apiErr.RetryAfter != 7 {
+		t.Errorf("apiError = %+v, %v", apiErr, ok)
+	}
+}
+
+func TestSendPhotoToBlockedChat(t *testing.T) {
+	bot, _ := testBot(t, map[int64]string{
+		3001: `{"ok":false,"error_code":403,"description":"Forbidden: bot was blocked by the user"}`,
+	})
+	db := newMemoryStorage()
+	photo := tgbotapi.NewPhotoUpload(3001, tgbotapi.FileBytes{Name: "chart.png", Bytes: []byte("png")})
+	if err := sendMessage(bot, db, 3001, photo); err == nil || isNetworkError(err) {
+		t.Errorf("sendMessage returned %v", err)
+	}
+	if !db.IsInactive(3001) {
+		t.Error("the chat is not marked inactive")
+	}
+}
+
+func TestPausedChatDoesNotHoldUpOthers(t *testing.T) {
+	bot, f := testBot(t, nil)
+	db := newMemoryStorage()
+	limiter.pause(4001, MAX_SEND_PAUSE)
+	t.Cleanup(func() {
+		limiter.lock.Lock()
+		delete(limiter.chats, 4001)
+		limiter.lock.Unlock()
+	})
+	start := time.Now()
+	for _, chat := range []int64{4001, 4001, 4002} {
+		db.AddOutbox(OutboxMessage{ID: newOutboxID(), Chat: chat, Text: "x", Created: time.Now()})
+	}
+	deliverOutbox(bot, db)
+	if outbox := db.Outbox(); len(outbox) != 2 || outbox[0].Chat != 4001 || outbox[1].Chat != 4001 {
+		t.Errorf("outbox = %v, want the notifications to the paused chat", outbox)
+	}
+
+	q := &replyQueue{bot: bot, db: db}
+	q.add(&tgbotapi.MessageConfig{BaseChat: tgbotapi.BaseChat{ChatID: 4001}, Text: "first"})
+	q.add(&tgbotapi.MessageConfig{BaseChat: tgbotapi.BaseChat{ChatID: 4003}, Text: "other"})
+	q.add(&tgbotapi.MessageConfig{BaseChat: tgbotapi.BaseChat{ChatID: 4001}, Text: "second"})
+	if len(q.pending) != 2 || q.pending[0].chat != 4001 || q.pending[1].chat != 4001 {
+		t.Errorf("pending replies = %v", q.pending)
+	}
+	q.flush()
+	if len(q.pending) != 2 {
+		t.Errorf("replies to the paused chat were sent: %v", q.pending)
+	}
+	if sent := f.delivered(); len(sent) != 2 || sent[0] != 4002 || sent[1] != 4003 {
+		t.Errorf("delivered to %v", sent)
+	}
+	if d := time.Since(start); d > CHAT_SEND_INTERVAL {
+		t.Errorf("the sender waited for %s", d)
+	}
+}
+
+func TestSendRetriesNetworkErrors(t *testing.T) {
+	bot, f := testBot(t, nil)
+	f.lock.Lock()
+	f.failures = 2
+	f.lock.Unlock()
+	db := newMemoryStorage()
+	if err := sendMessage(bot, db, 5001, tgbotapi.NewMessage(5001, "x")); err != nil {
+		t.Errorf("sendMessage = %v, want the message sent on the third attempt", err)
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.calls != 3 || len(f.sent) != 1 || f.sent[0] != 5001 {
+		t.Errorf("%d requests, delivered to %v", f.calls, f.sent)
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
-	"fmt"
-	"html"
+	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/go-telegram-bot-api/telegram-bot-api"
@@ -11,83 +13,259 @@ import (
 
 var messageChan = make(chan *tgbotapi.MessageConfig, 5)
 var callbackChan = make(chan tgbotapi.CallbackConfig, 5)
+var photoChan = make(chan tgbotapi.PhotoConfig, 5)
 
-func notifyUser(id int64, message string) {
-	m := tgbotapi.NewMessage(id, message)
-	m.ParseMode = "html"
-	m.DisableWebPagePreview = true
-	messageChan <- &m
+// SHUTDOWN_TIMEOUT is how long the monitor and the sender are waited for on shutdown.
+// Notifications that are not sent by then stay in the outbox until the next start.
+const SHUTDOWN_TIMEOUT = 20 * time.Second
+
+type pendingReply struct {
+	chat int64
+	m    tgbotapi.Chattable
 }
 
-func monitor() {
-	for range time.Tick(30 * time.Second) {
-		ul := userList()
-		clearTableCache()
-		for _, u := range ul {
-			pairs := recordList(u)
-			for _, v := range pairs {
-				data := parseList(v.Value)
-				cellval, err := cellValueByRecord(data)
-				if err != nil {
-					println(err.Error())
-					continue
-				}
-				if cellval == nil {
-					println("Could not fetch value")
-					continue
-				}
-				old := updateCellVal(u, v.Name, *cellval)
-				if old != *cellval {
-					notifyUser(u, fmt.Sprintf("<a href=\"%s\">%s</a> changed!\n'%s' -> '%s'",
-						buildEditURL(data), html.EscapeString(v.Name), html.EscapeString(old), html.EscapeString(*cellval)))
-				}
-			}
+// replyQueue keeps the replies to the chats that cannot get messages yet, so that the sender
+// goes on with the other chats meanwhile. The replies to a chat are sent in order.
+type replyQueue struct {
+	bot     *tgbotapi.BotAPI
+	db      Storage
+	pending []pendingReply
+}
+
+// add sends a reply waiting in one of the channels, or keeps it if the chat has to wait.
+func (q *replyQueue) add(m tgbotapi.Chattable) {
+	var chat int64
+	switch c := m.(type) {
+	case *tgbotapi.MessageConfig:
+		chat = c.ChatID
+	case tgbotapi.PhotoConfig:
+		chat = c.ChatID
+	}
+	for _, p := range q.pending {
+		if p.chat == chat {
+			q.pending = append(q.pending, pendingReply{chat, m})
+			return
 		}
 	}
+	if !q.send(chat, m) {
+		q.pending = append(q.pending, pendingReply{chat, m})
+	}
+}
+
+// send reports false if the chat cannot get messages yet.
+func (q *replyQueue) send(chat int64, m tgbotapi.Chattable) bool {
+	err := sendMessage(q.bot, q.db, chat, m)
+	if err == errChatPaused {
+		return false
+	}
+	if err != nil {
+		log.Printf("Could not reply to %d: %s", chat, err.Error())
+	}
+	return true
 }
 
-func sender(bot *tgbotapi.BotAPI) {
-	for ; ; {
+// flush sends the kept replies to the chats that can get messages again.
+func (q *replyQueue) flush() {
+	paused := make(map[int64]bool)
+	left := q.pending[:0]
+	for _, p := range q.pending {
+		if paused[p.chat] || !q.send(p.chat, p.m) {
+			paused[p.chat] = true
+			left = append(left, p)
+		}
+	}
+	q.pending = left
+}
+
+func answerCallback(bot *tgbotapi.BotAPI, c tgbotapi.CallbackConfig) {
+	err := sendLimited(0, func() error {
+		_, err := bot.AnswerCallbackQuery(c)
+		return err
+	})
+	if err != nil {
+		log.Println("Could not answer callback: " + err.Error())
+	}
+}
+
+// sendQueued sends one reply waiting in the channels and reports whether there was one.
+func sendQueued(q *replyQueue) bool {
+	select {
+	case m := <-messageChan:
+		if m != nil {
+			q.add(m)
+		}
+	case m := <-callbackChan:
+		answerCallback(q.bot, m)
+	case m := <-photoChan:
+		q.add(m)
+	default:
+		return false
+	}
+	return true
+}
+
+// sender sends the replies and the notifications from the outbox until stop is closed.
+// Then it sends what is left in the queues and tries the outbox once more before closing done.
+func sender(bot *tgbotapi.BotAPI, db Storage, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	q := &replyQueue{bot: bot, db: db}
+	retry := time.NewTicker(OUTBOX_RETRY)
+	defer retry.Stop()
+	// The kept replies are tried again with this ticker
+	resume := time.NewTicker(CHAT_SEND_INTERVAL)
+	defer resume.Stop()
+	// Notifications left over from the previous run
+	wakeOutbox()
+	for {
 		select {
 		case m := <-messageChan:
 			if m != nil {
-				bot.Send(m)
+				q.add(m)
 			}
 		case m := <-callbackChan:
-			bot.AnswerCallbackQuery(m)
+			answerCallback(bot, m)
+		case m := <-photoChan:
+			q.add(m)
+		case <-resume.C:
+			q.flush()
+		case <-outboxWake:
+			if deliverOutbox(bot, db) {
+				// The replies that came meanwhile get their turn before the next batch
+				wakeOutbox()
+			}
+		case <-retry.C:
+			wakeOutbox()
+		case <-stop:
+			for sendQueued(q) {
+			}
+			for deliverOutbox(bot, db) {
+			}
+			for len(q.pending) > 0 {
+				<-resume.C
+				q.flush()
+			}
+			return
 		}
 	}
 }
 
+// watchSignals returns a channel that is closed on SIGINT or SIGTERM.
+func watchSignals() <-chan struct{} {
+	res := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		log.Printf("Got %s, shutting down", sig)
+		signal.Stop(signals)
+		close(res)
+	}()
+	return res
+}
+
+// pollUpdates receives the updates by long polling until shutdown is closed.
+func pollUpdates(bot *tgbotapi.BotAPI, shutdown <-chan struct{}) <-chan tgbotapi.Update {
+	// Updates cannot be polled while a webhook is set
+	if _, err := bot.RemoveWebhook(); err != nil {
+		log.Println("Could not remove the webhook: " + err.Error())
+	}
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = 60
+	updates, err := bot.GetUpdatesChan(u)
+	if err != nil {
+		log.Panic(err)
+	}
+	res := make(chan tgbotapi.Update)
+	go func() {
+		defer close(res)
+		for {
+			select {
+			case <-shutdown:
+				bot.StopReceivingUpdates()
+				return
+			case update := <-updates:
+				select {
+				case res <- update:
+				case <-shutdown:
+					bot.StopReceivingUpdates()
+					return
+				}
+			}
+		}
+	}()
+	return res
+}
+
+// waitFor waits until done is closed or SHUTDOWN_TIMEOUT passes.
+func waitFor(name string, done <-chan struct{}) {
+	select {
+	case <-done:
+	case <-time.After(SHUTDOWN_TIMEOUT):
+		log.Printf("Gave up waiting for the %s", name)
+	}
+}
+
 func main() {
-	connect()
+	flag.Parse()
+	loadConfig()
+	if configMap["migrate"] == "true" {
+		users, records := migrateStorage(newRedisStorage(configMap["addr"], configMap["passwd"]), newBoltStorage(configMap["dbpath"]))
+		log.Printf("Migrated %d records of %d users into %s", records, users, configMap["dbpath"])
+		return
+	}
+	db := openStorage()
+	setupFetchers()
 	bot, err := tgbotapi.NewBotAPI(configMap["token"])
 	if err != nil {
 		log.Panic(err)
 	}
 	log.Printf("Authorized on account %s", bot.Self.UserName)
+	chatAPI, botUser = bot, bot.Self
 
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
-
-	updates, err := bot.GetUpdatesChan(u)
+	shutdown := watchSignals()
+	var updates <-chan tgbotapi.Update
+	if configMap["webhook"] != "" {
+		updates = listenWebhook(bot, shutdown)
+	} else {
+		updates = pollUpdates(bot, shutdown)
+	}
 
-	go monitor()
-	go sender(bot)
+	stopMonitor, monitorDone := make(chan struct{}), make(chan struct{})
+	stopSender, senderDone := make(chan struct{}), make(chan struct{})
+	go monitor(db, stopMonitor, monitorDone)
+	go sender(bot, db, stopSender, senderDone)
 
 	for update := range updates {
-		if update.CallbackQuery != nil {
-			log.Printf("[%s CALLBACK] %s", update.CallbackQuery.From.UserName, update.CallbackQuery.Data)
-			messageChan <- handleCallback(update.CallbackQuery.Message.Chat.ID, update.CallbackQuery.Data)
-			callbackChan <- tgbotapi.NewCallback(update.CallbackQuery.ID, "")
-			continue
-		}
-		if update.Message == nil {
-			continue
-		}
+		handleUpdate(db, update)
+	}
 
-		log.Printf("[%s] %s", update.Message.From.UserName, update.Message.Text)
+	// The monitor is stopped first, so that its last notifications reach the outbox before the sender drains it
+	close(stopMonitor)
+	waitFor("monitor", monitorDone)
+	close(stopSender)
+	waitFor("sender", senderDone)
+	log.Println("Stopped")
+}
 
-		messageChan <- handle(update.Message.Chat.ID, update.Message.Text)
+func handleUpdate(db Storage, update tgbotapi.Update) {
+	if update.CallbackQuery != nil {
+		log.Printf("[%s CALLBACK] %s", update.CallbackQuery.From.UserName, update.CallbackQuery.Data)
+		chat := update.CallbackQuery.Message.Chat
+		messageChan <- handleCallback(db, &chatMessage{chat: chat.ID, user: update.CallbackQuery.From.ID,
+			group: !chat.IsPrivate(), text: update.CallbackQuery.Data})
+		callbackChan <- tgbotapi.NewCallback(update.CallbackQuery.ID, "")
+		return
+	}
+	if update.Message == nil {
+		return
 	}
+	// Writing to the bot again unblocks it
+	if db.IsInactive(update.Message.Chat.ID) {
+		db.SetInactive(update.Message.Chat.ID, false)
+	}
+
+	log.Printf("[%s] %s", update.Message.From.UserName, update.Message.Text)
+
+	messageChan <- handle(db, &chatMessage{chat: update.Message.Chat.ID, user: update.Message.From.ID,
+		group: !update.Message.Chat.IsPrivate(), id: update.Message.MessageID, text: update.Message.Text})
 }
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStorage keeps everything in process memory. Nothing survives a restart,
+// so it is meant for development and tests.
+type memoryStorage struct {
+	lock    sync.Mutex
+	records map[int64]map[string]string
+	cells   map[int64]map[string]string
+	states  map[int64]storedState
+	history map[int64]map[string][]HistoryEntry
+	shares  map[string]RecordRef
+	// subscribers and subscriptions are the two directions of the same relation.
+	subscribers   map[RecordRef]map[int64]bool
+	subscriptions map[int64]map[RecordRef]bool
+	outbox        map[string]OutboxMessage
+	inactive      map[int64]bool
+}
+
+type storedState struct {
+	Values  map[string]string `json:"values"`
+	Expires time.Time         `json:"expires"`
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		records:       make(map[int64]map[string]string),
+		cells:         make(map[int64]map[string]string),
+		states:        make(map[int64]storedState),
+		history:       make(map[int64]map[string][]HistoryEntry),
+		shares:        make(map[string]RecordRef),
+		subscribers:   make(map[RecordRef]map[int64]bool),
+		subscriptions: make(map[int64]map[RecordRef]bool),
+		outbox:        make(map[string]OutboxMessage),
+		inactive:      make(map[int64]bool),
+	}
+}
+
+func (s *memoryStorage) RecordExists(uid int64, name string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.records[uid][name]
+	return ok
+}
+
+func (s *memoryStorage) GetRecord(uid int64, name string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	val, ok := s.records[uid][name]
+	return val, ok
+}
+
+func (s *memoryStorage) AddRecord(uid int64, name string, record string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.records[uid] == nil {
+		s.records[uid] = make(map[string]string)
+	}
+	s.records[uid][name] = record
+}
+
+func (s *memoryStorage) RecordList(uid int64) StringPairs {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return sortedPairs(s.records[uid])
+}
+
+func (s *memoryStorage) DeleteRecord(uid int64, name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.records[uid], name)
+	if len(s.records[uid]) == 0 {
+		delete(s.records, uid)
+	}
+}
+
+func (s *memoryStorage) UserList() []int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := make([]int64, 0, len(s.records))
+	for uid := range s.records {
+		res = append(res, uid)
+	}
+	return res
+}
+
+func (s *memoryStorage) GetCellVal(uid int64, name string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	val, ok := s.cells[uid][name]
+	return val, ok
+}
+
+func (s *memoryStorage) UpdateCellVal(uid int64, name string, value string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.cells[uid] == nil {
+		s.cells[uid] = make(map[string]string)
+	}
+	old, ok := s.cells[uid][name]
+	s.cells[uid][name] = value
+	if !ok {
+		return value
+	}
+	return old
+}
+
+func (s *memoryStorage) AddHistory(uid int64, name string, entry HistoryEntry, limit int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if limit <= 0 {
+		delete(s.history[uid], name)
+		return
+	}
+	if s.history[uid] == nil {
+		s.history[uid] = make(map[string][]HistoryEntry)
+	}
+	h := append(s.history[uid][name], entry)
+	if len(h) > limit {
+		h = append([]HistoryEntry(nil), h[len(h)-limit:]...)
+	}
+	s.history[uid][name] = h
+}
+
+func (s *memoryStorage) History(uid int64, name string) []HistoryEntry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]HistoryEntry{}, s.history[uid][name]...)
+}
+
+func (s *memoryStorage) DeleteHistory(uid int64, name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.history[uid], name)
+}
+
+func (s *memoryStorage) GetState(uid int64) map[string]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := make(map[string]string)
+	st, ok := s.states[uid]
+	if !ok || time.Now().After(st.Expires) {
+		delete(s.states, uid)
+		return res
+	}
+	for k, v := range st.Values {
+		res[k] = v
+	}
+	return res
+}
+
+func (s *memoryStorage) SetState(uid int64, state map[string]string, ttl time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(state) == 0 {
+		delete(s.states, uid)
+		return
+	}
+	values := make(map[string]string, len(state))
+	for k, v := range state {
+		values[k] = v
+	}
+	s.states[uid] = storedState{values, time.Now().Add(ttl)}
+}
+
+func (s *memoryStorage) DeleteCellVal(uid int64, name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.cells[uid], name)
+}
+
+func (s *memoryStorage) AddShare(code string, rec RecordRef) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.shares[code] = rec
+}
+
+func (s *memoryStorage) GetShare(code string) (RecordRef, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	rec, ok := s.shares[code]
+	return rec, ok
+}
+
+func (s *memoryStorage) DeleteShare(code string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.shares, code)
+}
+
+func (s *memoryStorage) Subscribe(sub int64, rec RecordRef) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.subscribers[rec] == nil {
+		s.subscribers[rec] = make(map[int64]bool)
+	}
+	if s.subscriptions[sub] == nil {
+		s.subscriptions[sub] = make(map[RecordRef]bool)
+	}
+	s.subscribers[rec][sub] = true
+	s.subscriptions[sub][rec] = true
+}
+
+func (s *memoryStorage) Unsubscribe(sub int64, rec RecordRef) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.subscribers[rec], sub)
+	if len(s.subscribers[rec]) == 0 {
+		delete(s.subscribers, rec)
+	}
+	delete(s.subscriptions[sub], rec)
+	if len(s.subscriptions[sub]) == 0 {
+		delete(s.subscriptions, sub)
+	}
+}
+
+func (s *memoryStorage) Subscribers(rec RecordRef) []int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := make([]int64, 0, len(s.subscribers[rec]))
+	for sub := range s.subscribers[rec] {
+		res = append(res, sub)
+	}
+	return res
+}
+
+func (s *memoryStorage) Subscriptions(sub int64) []RecordRef {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := make([]RecordRef, 0, len(s.subscriptions[sub]))
+	for rec := range s.subscriptions[sub] {
+		res = append(res, rec)
+	}
+	return res
+}
+
+func (s *memoryStorage) AddOutbox(msg OutboxMessage) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.outbox[msg.ID] = msg
+}
+
+func (s *memoryStorage) Outbox() []OutboxMessage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := make(outboxMessages, 0, len(s.outbox))
+	for _, msg := range s.outbox {
+		res = append(res, msg)
+	}
+	sort.Sort(res)
+	return res
+}
+
+func (s *memoryStorage) DeleteOutbox(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.outbox, id)
+}
+
+func (s *memoryStorage) SetInactive(chat int64, inactive bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if inactive {
+		s.inactive[chat] = true
+	} else {
+		delete(s.inactive, chat)
+	}
+}
+
+func (s *memoryStorage) IsInactive(chat int64) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.inactive[chat]
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type monitorJob struct {
+	uid  int64
+	name string
+	rec  *Record
+}
+
+// monitor checks the records every interval until stop is closed. A cycle that has
+// already started is finished first. done is closed when the monitor has stopped.
+func monitor(db Storage, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	interval := configDuration("interval")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		start := time.Now()
+		tables.prune(2 * interval)
+		runMonitorCycle(db, configInt("workers"))
+		if spent := time.Since(start); spent > interval {
+			log.Printf("Monitor cycle took %s, longer than the %s interval", spent, interval)
+		}
+	}
+}
+
+// runMonitorCycle checks every record once. Records are grouped by spreadsheet,
+// so that each document is fetched once per cycle no matter how many users watch it.
+func runMonitorCycle(db Storage, workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	groups := make(map[string][]monitorJob)
+	for _, u := range db.UserList() {
+		for _, v := range db.RecordList(u) {
+			rec, err := decodeRecord(v.Value)
+			if err != nil {
+				log.Printf("Bad record %s of %d: %s", v.Name, u, err.Error())
+				continue
+			}
+			if !hasAudience(db, u, v.Name, rec) {
+				continue
+			}
+			groups[rec.TableName()] = append(groups[rec.TableName()], monitorJob{u, v.Name, rec})
+		}
+	}
+	queue := make(chan string)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range queue {
+				checkTable(db, name, groups[name])
+			}
+		}()
+	}
+	for name := range groups {
+		queue <- name
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// hasAudience reports whether somebody still gets the notifications about the record.
+// Records only watched by chats that have blocked the bot are not checked until they come back.
+func hasAudience(db Storage, uid int64, name string, rec *Record) bool {
+	if !db.IsInactive(notifyTarget(uid, rec)) {
+		return true
+	}
+	for _, sub := range db.Subscribers(RecordRef{uid, name}) {
+		if !db.IsInactive(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyAudience sends the message to the chat that gets the notifications about the record and to its subscribers.
+func notifyAudience(db Storage, uid int64, name string, rec *Record, msg string) {
+	notifyUser(db, notifyTarget(uid, rec), msg)
+	for _, sub := range db.Subscribers(RecordRef{uid, name}) {
+		notifyUser(db, sub, msg)
+	}
+}
+
+// checkedVersions remembers which version of every document the monitor has already looked at.
+var checkedVersions = struct {
+	sync.Mutex
+	m map[string]uint64
+}{m: make(map[string]uint64)}
+
+// markChecked records that the monitor has looked at the entry and reports
+// whether it had already looked at the same version before.
+func markChecked(entry *tableEntry) bool {
+	checkedVersions.Lock()
+	defer checkedVersions.Unlock()
+	unchanged := checkedVersions.m[entry.key] == entry.version
+	checkedVersions.m[entry.key] = entry.version
+	return unchanged
+}
+
+// missingTabs holds the records whose users were told that their tab was deleted.
+var missingTabs = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+// tabDeleted reports whether the document lists its tabs and the tab of the record is not among them.
+func tabDeleted(rec *Record, sheet *Sheet) bool {
+	return rec.Kind != KIND_TABS && len(sheet.Tabs) > 0 && sheet.Tab(rec.Gid) == nil
+}
+
+// warnMissingTab records whether the tab of the record is missing and reports
+// whether it has just gone missing, so that the user is warned once.
+func warnMissingTab(uid int64, name string, missing bool) bool {
+	key := strconv.FormatInt(uid, 10) + "/" + name
+	missingTabs.Lock()
+	defer missingTabs.Unlock()
+	if !missing {
+		delete(missingTabs.m, key)
+		return false
+	}
+	if missingTabs.m[key] {
+		return false
+	}
+	missingTabs.m[key] = true
+	return true
+}
+
+func checkTable(db Storage, name string, jobs []monitorJob) {
+	unchanged := make(map[string]bool)
+	for _, job := range jobs {
+		entry, sheet, err := recordSource(job.rec)
+		if entry == nil {
+			log.Println("Could not fetch " + name)
+			continue
+		}
+		if err != nil {
+			log.Println("Could not parse " + entry.key + ": " + err.Error())
+			continue
+		}
+		same, ok := unchanged[entry.key]
+		if !ok {
+			same = markChecked(entry)
+			unchanged[entry.key] = same
+		}
+		if same {
+			// The document is the same as in the previous cycle, so only the records
+			// that have no value yet need to be looked at.
+			if _, ok := db.GetCellVal(job.uid, job.name); ok {
+				continue
+			}
+		}
+		cellval, err := valueFromSheet(job.rec, sheet)
+		if tabDeleted(job.rec, sheet) {
+			if warnMissingTab(job.uid, job.name, true) {
+				notifyAudience(db, job.uid, job.name, job.rec, fmt.Sprintf("<a href=\"%s\">%s</a>: the tab of this cell was deleted. "+
+					"I will keep checking in case it comes back.", buildEditURL(job.rec), html.EscapeString(job.name)))
+			}
+			continue
+		}
+		warnMissingTab(job.uid, job.name, false)
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		if cellval == nil {
+			log.Println("Could not fetch value")
+			continue
+		}
+		_, known := db.GetCellVal(job.uid, job.name)
+		old := db.UpdateCellVal(job.uid, job.name, *cellval)
+		if !known {
+			// The first value is where /history and /chart start from
+			db.AddHistory(job.uid, job.name, HistoryEntry{time.Now(), *cellval}, configInt("history"))
+			continue
+		}
+		if old == *cellval {
+			continue
+		}
+		msg, changed := changeMessage(job.rec, job.name, old, *cellval)
+		if !changed {
+			continue
+		}
+		db.AddHistory(job.uid, job.name, HistoryEntry{time.Now(), *cellval}, configInt("history"))
+		if recordCondition(job.rec).Match(displayValue(old), displayValue(*cellval)) {
+			notifyAudience(db, job.uid, job.name, job.rec, msg)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMonitorCycleWorkers(t *testing.T) {
+	useFetchers(t, map[string]Fetcher{FETCH_HTML: &stubFetcher{testPage}})
+	db := newMemoryStorage()
+	rec := &Record{Version: RECORD_VERSION, Spreadsheet: "d/workers", Gid: "0", Kind: KIND_RANGE}
+	rec.SetRange("C", "2", "", "")
+	db.AddRecord(1, "price", rec.Encode())
+	for _, workers := range []int{0, -1, 2} {
+		db.DeleteCellVal(1, "price")
+		done := make(chan struct{})
+		go func() {
+			runMonitorCycle(db, workers)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("cycle with %d workers does not finish", workers)
+		}
+		if v, ok := db.GetCellVal(1, "price"); !ok || v != "10" {
+			t.Errorf("%d workers: value = %q, %v", workers, v, ok)
+		}
+	}
+}
+
+func TestMonitorHistoryBaseline(t *testing.T) {
+	google := &googleStandIn{}
+	google.set(testPage, "")
+	srv := httptest.NewServer(google)
+	defer srv.Close()
+	useFetchers(t, map[string]Fetcher{FETCH_HTML: &htmlFetcher{testClient(), srv.URL + "/"}})
+	db := newMemoryStorage()
+	rec := &Record{Version: RECORD_VERSION, Spreadsheet: "d/abc", Gid: "0", Kind: KIND_RANGE}
+	rec.SetRange("C", "2", "", "")
+	db.AddRecord(1, "price", rec.Encode())
+	runMonitorCycle(db, 1)
+	google.set(strings.Replace(testPage, "<td>10</td>", "<td>15</td>", 1), "")
+	runMonitorCycle(db, 1)
+	history := db.History(1, "price")
+	if len(history) != 2 || history[0].Value != "10" || history[1].Value != "15" {
+		t.Errorf("history = %v, want the first value and the change", history)
+	}
+}
+
+func TestMonitorMissingTab(t *testing.T) {
+	withoutSecond := strings.Replace(strings.Replace(testPage, `<li id="sheet-button-77"><a>Second</a></li>`, "", 1),
+		`<div id="77"><div><table><thead><tr><th></th><th style="w">A</th></tr></thead><tbody>`+
+			`<tr style="h"><th><div>1</div></th><td>x</td></tr></tbody></table></div></div>`, "", 1)
+	google := &googleStandIn{}
+	google.set(testPage, "")
+	srv := httptest.NewServer(google)
+	defer srv.Close()
+	useFetchers(t, map[string]Fetcher{FETCH_HTML: &htmlFetcher{testClient(), srv.URL + "/"}})
+	db := newMemoryStorage()
+	rec := &Record{Version: RECORD_VERSION, Spreadsheet: "d/abc", Gid: "77", Kind: KIND_RANGE}
+	rec.SetRange("A", "1", "", "")
+	db.AddRecord(20, "second", rec.Encode())
+	db.Subscribe(21, RecordRef{20, "second"})
+	warnings := func() int {
+		n := 0
+		for _, m := range db.Outbox() {
+			if strings.Contains(m.Text, "the tab of this cell was deleted") {
+				n++
+			}
+			db.DeleteOutbox(m.ID)
+		}
+		return n
+	}
+	for i, page := range []string{testPage, withoutSecond, withoutSecond, testPage, withoutSecond} {
+		google.set(page, "")
+		runMonitorCycle(db, 1)
+		// The owner and the subscriber are warned
+		want := 0
+		if i == 1 || i == 4 {
+			want = 2
+		}
+		if n := warnings(); n != want {
+			t.Errorf("cycle %d: %d warnings, want %d", i, n, want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// OUTBOX_RETRY is how often undelivered notifications are sent again.
+const OUTBOX_RETRY = 30 * time.Second
+
+// OUTBOX_MAX_AGE is how long a notification is retried before it is dropped.
+const OUTBOX_MAX_AGE = 24 * time.Hour
+
+// OUTBOX_BATCH is how many notifications are sent at once, so that the replies do not wait for the whole outbox.
+const OUTBOX_BATCH = 20
+
+// outboxWake tells the sender that a notification was added to the outbox.
+var outboxWake = make(chan struct{}, 1)
+
+var outboxSeq uint64
+
+func newOutboxID() string {
+	return fmt.Sprintf("%019d-%06d", time.Now().UnixNano(), atomic.AddUint64(&outboxSeq, 1)%1000000)
+}
+
+// notifyUser stores the notification in the outbox and wakes the sender up. It never waits for the sender,
+// and the notification survives a restart until it is delivered.
+// Chats that have blocked the bot are skipped.
+func notifyUser(db Storage, id int64, message string) {
+	if db.IsInactive(id) {
+		return
+	}
+	db.AddOutbox(OutboxMessage{ID: newOutboxID(), Chat: id, Text: message, Created: time.Now()})
+	wakeOutbox()
+}
+
+// wakeOutbox tells the sender to deliver the outbox, unless it has been told already.
+func wakeOutbox() {
+	select {
+	case outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+func outboxMessage(m OutboxMessage) tgbotapi.MessageConfig {
+	msg := tgbotapi.NewMessage(m.Chat, m.Text)
+	msg.ParseMode = "html"
+	msg.DisableWebPagePreview = true
+	return msg
+}
+
+// deliverOutbox sends up to OUTBOX_BATCH stored notifications in order and reports whether
+// there are more. The ones that fail to reach Telegram are kept for the next attempt, unless
+// they are older than OUTBOX_MAX_AGE. The ones Telegram rejects are dropped, as it would
+// reject them again, and so are the notifications to the chats that have blocked the bot.
+// The chats that cannot get messages yet are skipped and tried again in CHAT_SEND_INTERVAL.
+func deliverOutbox(bot *tgbotapi.BotAPI, db Storage) bool {
+	sent := 0
+	paused := make(map[int64]bool)
+	defer func() {
+		if len(paused) > 0 {
+			time.AfterFunc(CHAT_SEND_INTERVAL, wakeOutbox)
+		}
+	}()
+	for _, m := range db.Outbox() {
+		if sent == OUTBOX_BATCH {
+			return true
+		}
+		if db.IsInactive(m.Chat) {
+			db.DeleteOutbox(m.ID)
+			continue
+		}
+		// The notifications to a chat are kept in order
+		if paused[m.Chat] {
+			continue
+		}
+		err := sendMessage(bot, db, m.Chat, outboxMessage(m))
+		if err == errChatPaused {
+			paused[m.Chat] = true
+			continue
+		}
+		sent++
+		if err != nil {
+			if !isRetryable(err) || time.Since(m.Created) > OUTBOX_MAX_AGE {
+				log.Printf("Dropping notification to %d: %s", m.Chat, err.Error())
+				db.DeleteOutbox(m.ID)
+				continue
+			}
+			log.Printf("Could not notify %d: %s", m.Chat, err.Error())
+			if isNetworkError(err) {
+				// The rest would fail too, they are sent on the next attempt
+				return false
+			}
+			continue
+		}
+		db.DeleteOutbox(m.ID)
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// fakeTelegram answers the Bot API requests. Messages to the chats in answers get that answer,
+// the others are delivered and their chats are recorded in sent. The first failures messages
+// do not reach it, as if the network was down.
+type fakeTelegram struct {
+	lock     sync.Mutex
+	answers  map[int64]string
+	sent     []int64
+	failures int
+	calls    int
+}
+
+func (f *fakeTelegram) RoundTrip(r *http.Request) (*http.Response, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	answer := `{"ok":true,"result":{"id":99,"is_bot":true,"first_name":"Mon","username":"MonBot"}}`
+	if !strings.HasSuffix(r.URL.Path, "/getMe") {
+		f.calls++
+		if f.failures > 0 {
+			f.failures--
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+		}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+			r.ParseMultipartForm(1 << 20)
+		}
+		chat, _ := strconv.ParseInt(r.FormValue("chat_id"), 10, 64)
+		var ok bool
+		if answer, ok = f.answers[chat]; !ok {
+			f.sent = append(f.sent, chat)
+			answer = `{"ok":true,"result":{"message_id":1,"chat":{"id":` + strconv.FormatInt(chat, 10) + `},"date":0}}`
+		}
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(answer)),
+		Request:    r,
+	}, nil
+}
+
+func (f *fakeTelegram) delivered() []int64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]int64(nil), f.sent...)
+}
+
+// testBot returns a bot that talks to the fake Telegram.
+func testBot(t *testing.T, answers map[int64]string) (*tgbotapi.BotAPI, *fakeTelegram) {
+	f := &fakeTelegram{answers: answers}
+	bot, err := tgbotapi.NewBotAPIWithClient("token", &http.Client{Transport: f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bot, f
+}
+
+func TestDeliverOutboxDropsRejected(t *testing.T) {
+	bot, f := testBot(t, map[int64]string{
+		1001: `{"ok":false,"error_code":400,"description":"Bad Request: can't parse entities"}`,
+		1002: `{"ok":false,"error_code":403,"description":"Forbidden: bot was blocked by the user"}`,
+	})
+	db := newMemoryStorage()
+	for _, chat := range []int64{1001, 1002, 1003} {
+		db.AddOutbox(OutboxMessage{ID: newOutboxID(), Chat: chat, Text: "x", Created: time.Now()})
+	}
+	if deliverOutbox(bot, db) {
+		t.Error("deliverOutbox reported more notifications")
+	}
+	if outbox := db.Outbox(); len(outbox) != 0 {
+		t.Errorf("outbox = %v, want the rejected notifications dropped", outbox)
+	}
+	if sent := f.delivered(); len(sent) != 1 || sent[0] != 1003 {
+		t.Errorf("delivered to %v", sent)
+	}
+	if db.IsInactive(1001) || !db.IsInactive(1002) {
+		t.Error("only the chat that has blocked the bot should be inactive")
+	}
+}
+
+func TestDeliverOutboxBatch(t *testing.T) {
+	bot, f := testBot(t, nil)
+	db := newMemoryStorage()
+	for chat := int64(2000); chat < 2000+OUTBOX_BATCH+5; chat++ {
+		db.AddOutbox(OutboxMessage{ID: newOutboxID(), Chat: chat, Text: "x", Created: time.Now()})
+	}
+	if !deliverOutbox(bot, db) {
+		t.Error("deliverOutbox sent everything at once")
+	}
+	if sent := f.delivered(); len(sent) != OUTBOX_BATCH || sent[0] != 2000 {
+		t.Errorf("first batch went to %v", sent)
+	}
+	if deliverOutbox(bot, db) {
+		t.Error("deliverOutbox reported more notifications after the last batch")
+	}
+	if outbox := db.Outbox(); len(outbox) != 0 || len(f.delivered()) != OUTBOX_BATCH+5 {
+		t.Errorf("outbox = %v, delivered to %v", outbox, f.delivered())
+	}
+}
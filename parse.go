@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/csv"
 	"errors"
+	"fmt"
 	"strconv"
 	"strings"
 
@@ -18,6 +20,17 @@ func colToInt(col string) int {
 	return ans
 }
 
+// intToCol is the inverse of colToInt.
+func intToCol(n int) string {
+	res := ""
+	for n > 0 {
+		n--
+		res = string(rune('A'+n%26)) + res
+		n /= 26
+	}
+	return res
+}
+
 func getAttr(node *html.Node, arg string) string {
 	for _, v := range node.Attr {
 		if v.Key == arg {
@@ -27,25 +40,53 @@ func getAttr(node *html.Node, arg string) string {
 	return ""
 }
 
-func getGid(n *html.Node, gid string) *html.Node {
-	for c := n.FirstChild; c != nil; c = c.NextSibling {
-		if getAttr(c, "id") == gid {
-			return c.FirstChild.FirstChild
-		}
+func getText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
 	}
-	return nil
+	res := ""
+	for i := n.FirstChild; i != nil; i = i.NextSibling {
+		res += getText(i)
+	}
+	return res
 }
 
-func getPageList(data string) (names []string, gids []string) {
+// parseSheet builds the grid model out of an htmlview or pubhtml page.
+func parseSheet(data string) (sheet *Sheet, err error) {
 	if data == "" {
-		return nil, nil
+		return nil, errors.New("Empty document")
 	}
+	defer func() {
+		if r := recover(); r != nil {
+			sheet, err = nil, fmt.Errorf("Unexpected document structure: %v", r)
+		}
+	}()
 	doc, err := html.Parse(strings.NewReader(data))
 	if err != nil {
-		println(err.Error())
-		return nil, nil
+		return nil, err
+	}
+	body := doc.LastChild.LastChild
+	sheet = &Sheet{byGid: make(map[string]*Tab)}
+	for c := body.FirstChild.NextSibling.FirstChild; c != nil; c = c.NextSibling {
+		if gid := getAttr(c, "id"); gid != "" {
+			tab := &Tab{Gid: gid}
+			parseTab(tab, c.FirstChild.FirstChild)
+			sheet.byGid[gid] = tab
+		}
+	}
+	names, gids := parsePageList(body.FirstChild)
+	for i, gid := range gids {
+		tab, ok := sheet.byGid[gid]
+		if !ok {
+			tab = &Tab{Gid: gid}
+		}
+		tab.Name = names[i]
+		sheet.Tabs = append(sheet.Tabs, tab)
 	}
-	doc = doc.LastChild.LastChild.FirstChild
+	return sheet, nil
+}
+
+func parsePageList(doc *html.Node) (names []string, gids []string) {
 	if doc.FirstChild == doc.LastChild {
 		doc = doc.NextSibling.FirstChild
 		names = append(names, "")
@@ -64,137 +105,96 @@ func getPageList(data string) (names []string, gids []string) {
 	return
 }
 
-func getPageListString(data string) *string {
-	names, _ := getPageList(data)
-	if names == nil {
-		return nil
-	}
-	res := strings.Join(names, ", ")
-	return &res
-}
-
-func getText(n *html.Node) string {
-	if n.Type == html.TextNode {
-		return n.Data
-	}
-	res := ""
-	for i := n.FirstChild; i != nil; i = i.NextSibling {
-		res += getText(i)
-	}
-	return res
-}
-
-func calcVOffset(n *html.Node, row string) int {
-	res := 0
-	for tr := n.LastChild.FirstChild; tr != nil; tr = tr.NextSibling {
-		if getAttr(tr, "style") == "" {
-			continue
-		}
-		res++
-		if tr.FirstChild.FirstChild.FirstChild.Data == row {
-			return res
-		}
-	}
-	t, _ := strconv.ParseInt(row, 10, 64)
-	return int(t)
-}
-
-func calcHOffset(n *html.Node, col string) int {
-	res := 0
-	for th := n.FirstChild.FirstChild.FirstChild; th != nil; th = th.NextSibling {
+// parseTab fills the labels and cells of the tab from its <table>.
+// Rows and columns without a style are hidden and are skipped.
+func parseTab(tab *Tab, g *html.Node) {
+	tab.Cells = make([][]*Cell, 0)
+	for th := g.FirstChild.FirstChild.FirstChild; th != nil; th = th.NextSibling {
 		if getAttr(th, "style") == "" {
 			continue
 		}
-		res++
-		if th.FirstChild != nil && th.FirstChild.Data == col {
-			return res
+		label := ""
+		if th.FirstChild != nil {
+			label = th.FirstChild.Data
 		}
+		tab.Cols = append(tab.Cols, label)
 	}
-	return colToInt(col)
-}
-
-func extractCellValue(data string, gid string, row1 string, col1 string, row2 string, col2 string) (string, error) {
-	defer func() {
-		recover()
-	}()
-	doc, err := html.Parse(strings.NewReader(data))
-	if err != nil {
-		println(err.Error())
-		return "", err
-	}
-	g := getGid(doc.LastChild.LastChild.FirstChild.NextSibling, gid)
-	if g == nil {
-		return "", errors.New("Page " + gid + " does not exist")
+	var busy [][]bool
+	isBusy := func(r, c int) bool {
+		return r < len(busy) && c < len(busy[r]) && busy[r][c]
 	}
-	x1 := calcVOffset(g, row1)
-	if x1 < 0 {
-		return "", errors.New("Row " + row1 + " does not exist")
-	}
-	y1 := calcHOffset(g, col1)
-	if y1 < 0 {
-		return "", errors.New("Col " + col1 + " does not exist")
-	}
-	x2 := calcVOffset(g, row2)
-	if x2 < 0 {
-		return "", errors.New("Row " + row2 + " does not exist")
-	}
-	y2 := calcHOffset(g, col2)
-	if y2 < 0 {
-		return "", errors.New("Col " + col2 + " does not exist")
-	}
-	if x1 > x2 {
-		x1, x2 = x2, x1
-	}
-	if y1 > y2 {
-		y1, y2 = y2, y1
-	}
-	cx, cy := 0, 0
-	busy := make([][]bool, x2+1)
-	for i := range busy {
-		busy[i] = make([]bool, y2+1)
-	}
-	result := ""
 	for tr := g.LastChild.FirstChild; tr != nil; tr = tr.NextSibling {
 		if getAttr(tr, "style") == "" {
 			continue
 		}
-		cx++
-		if cx > x2 {
-			break
+		label := ""
+		if h := tr.FirstChild; h != nil && h.FirstChild != nil && h.FirstChild.FirstChild != nil {
+			label = h.FirstChild.FirstChild.Data
 		}
-		cy = 0
+		tab.Rows = append(tab.Rows, label)
+		r := len(tab.Rows) - 1
+		var row []*Cell
+		c := 0
 		for td := tr.FirstChild; td != nil; td = td.NextSibling {
 			if td.Data == "th" || getAttr(td, "class") == "freezebar-cell" {
 				continue
 			}
-			cy++
-			for cy <= y2 && busy[cx][cy] {
-				cy++
+			for isBusy(r, c) {
+				c++
 			}
-			if cy > y2 {
-				break
+			for len(row) <= c {
+				row = append(row, nil)
 			}
-			if x1 <= cx && cx <= x2 && y1 <= cy && cy <= y2 {
-				result += getText(td) + "\t"
+			cell := &Cell{Text: getText(td), RowSpan: 1, ColSpan: 1}
+			if v, err := strconv.Atoi(getAttr(td, "rowspan")); err == nil && v > 0 {
+				cell.RowSpan = v
 			}
-			colspan, rowspan := getAttr(td, "colspan"), getAttr(td, "rowspan")
-			if colspan != "" || rowspan != "" {
-				if colspan == "" {
-					colspan = "1"
-				}
-				if rowspan == "" {
-					rowspan = "1"
+			if v, err := strconv.Atoi(getAttr(td, "colspan")); err == nil && v > 0 {
+				cell.ColSpan = v
+			}
+			row[c] = cell
+			for ix := r; ix < r+cell.RowSpan; ix++ {
+				for len(busy) <= ix {
+					busy = append(busy, nil)
 				}
-				dx, _ := strconv.ParseInt(rowspan, 10, 64)
-				dy, _ := strconv.ParseInt(colspan, 10, 64)
-				for ix := cx; ix < cx+int(dx) && ix <= x2; ix++ {
-					for iy := cy; iy < cy+int(dy) && iy <= y2; iy++ {
-						busy[ix][iy] = true
+				for iy := c; iy < c+cell.ColSpan; iy++ {
+					for len(busy[ix]) <= iy {
+						busy[ix] = append(busy[ix], false)
 					}
+					busy[ix][iy] = true
 				}
 			}
+			c++
+		}
+		tab.Cells = append(tab.Cells, row)
+	}
+}
+
+// parseCSVSheet builds a single tab out of a CSV export. Rows and columns are labelled
+// by their numbers, as the export does not contain hidden ones.
+func parseCSVSheet(gid string, data string) (*Sheet, error) {
+	r := csv.NewReader(strings.NewReader(data))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	tab := &Tab{Gid: gid, Cells: make([][]*Cell, 0, len(records))}
+	width := 0
+	for i, fields := range records {
+		tab.Rows = append(tab.Rows, strconv.Itoa(i+1))
+		row := make([]*Cell, len(fields))
+		for j, field := range fields {
+			row[j] = &Cell{Text: field, RowSpan: 1, ColSpan: 1}
 		}
+		if len(fields) > width {
+			width = len(fields)
+		}
+		tab.Cells = append(tab.Cells, row)
+	}
+	for j := 1; j <= width; j++ {
+		tab.Cols = append(tab.Cols, intToCol(j))
 	}
-	result = strings.Trim(result, "\t")
-	return result, nil
+	return &Sheet{Tabs: []*Tab{tab}, byGid: map[string]*Tab{gid: tab}}, nil
 }
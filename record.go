@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// RECORD_VERSION is the version written into every newly encoded record.
+// Records stored before versioning was introduced are JSON arrays of DATA_LENGTH strings.
+const RECORD_VERSION = 1
+
+const DATA_LENGTH = 6
+
+const (
+	KIND_RANGE = "range"
+	KIND_TABS  = "tabs"
+	// KIND_TABLE records watch the rows of a column range that has no fixed end row.
+	// Rows are told apart by the value in the column stored in Options["key"].
+	KIND_TABLE = "table"
+	// KIND_LOOKUP records find their cell on every check: the column is the one titled
+	// Options["header"] in the first row, and the row is the one where the column
+	// Options["keycol"] holds Options["keyval"].
+	KIND_LOOKUP = "lookup"
+)
+
+// kindOptions are the options that only make sense for a single kind of record.
+var kindOptions = []string{"key", "header", "keycol", "keyval"}
+
+// Record describes a single monitored cell, range or tab list.
+type Record struct {
+	Version int `json:"version"`
+	// Spreadsheet is the path of the document under docs.google.com/spreadsheets/, e.g. "d/<id>" or "d/e/<id>".
+	Spreadsheet string `json:"spreadsheet"`
+	// Published is set for documents opened through /pubhtml instead of /htmlview.
+	Published bool              `json:"published,omitempty"`
+	Gid       string            `json:"gid"`
+	Kind      string            `json:"kind"`
+	Col1      string            `json:"col1,omitempty"`
+	Row1      string            `json:"row1,omitempty"`
+	Col2      string            `json:"col2,omitempty"`
+	Row2      string            `json:"row2,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	Options   map[string]string `json:"options,omitempty"`
+}
+
+func decodeRecord(s string) (*Record, error) {
+	if strings.HasPrefix(s, "[") {
+		return decodeLegacyRecord(s)
+	}
+	var rec Record
+	if err := json.Unmarshal([]byte(s), &rec); err != nil {
+		return nil, err
+	}
+	if rec.Version > RECORD_VERSION {
+		return nil, errors.New("Unsupported record version")
+	}
+	return &rec, nil
+}
+
+// decodeLegacyRecord reads the old positional format:
+// [path, gid, col1, row1, col2, row2], where col1 == "tabs" marks a tab list record
+// and path ends with "/pubhtml" for published documents.
+func decodeLegacyRecord(s string) (*Record, error) {
+	var data []string
+	if err := json.Unmarshal([]byte(s), &data); err != nil {
+		return nil, err
+	}
+	if len(data) != DATA_LENGTH {
+		return nil, errors.New("Bad legacy record length")
+	}
+	rec := &Record{Version: RECORD_VERSION, Spreadsheet: data[0], Gid: data[1], Kind: KIND_RANGE}
+	if strings.HasSuffix(rec.Spreadsheet, "/pubhtml") {
+		rec.Spreadsheet = strings.TrimSuffix(rec.Spreadsheet, "/pubhtml")
+		rec.Published = true
+	}
+	if data[2] == "tabs" {
+		rec.Kind = KIND_TABS
+	} else {
+		rec.Col1, rec.Row1, rec.Col2, rec.Row2 = data[2], data[3], data[4], data[5]
+	}
+	return rec, nil
+}
+
+func (rec *Record) Encode() string {
+	data, _ := json.Marshal(rec)
+	return string(data)
+}
+
+// TableName is the key under which the fetched document is cached.
+func (rec *Record) TableName() string {
+	if rec.Published {
+		return rec.Spreadsheet + "/pubhtml"
+	}
+	return rec.Spreadsheet
+}
+
+// HasRange reports whether the record already knows what to monitor on its page.
+func (rec *Record) HasRange() bool {
+	return rec.Kind == KIND_TABS || rec.Kind == KIND_LOOKUP || rec.Col1 != "" || rec.Row1 != ""
+}
+
+// IsCell reports whether the record watches a single cell.
+func (rec *Record) IsCell() bool {
+	return rec.Kind == KIND_RANGE && isCell(rec.Col1, rec.Row1, rec.Col2, rec.Row2)
+}
+
+// HasNumber reports whether the value of the record is the text of a single cell,
+// so that it can be read as a number.
+func (rec *Record) HasNumber() bool {
+	return rec.IsCell() || rec.Kind == KIND_LOOKUP
+}
+
+func isCell(col1, row1, col2, row2 string) bool {
+	return col1 != "" && row1 != "" && col1 == col2 && row1 == row2
+}
+
+// setKind switches the record to another kind and forgets what the previous one monitored.
+// The options are copied rather than changed in place, as copies of the record share the map.
+func (rec *Record) setKind(kind string) {
+	rec.Kind = kind
+	rec.Col1, rec.Row1, rec.Col2, rec.Row2 = "", "", "", ""
+	if rec.Options == nil {
+		return
+	}
+	options := make(map[string]string, len(rec.Options))
+	for key, value := range rec.Options {
+		options[key] = value
+	}
+	for _, key := range kindOptions {
+		delete(options, key)
+	}
+	rec.Options = options
+}
+
+// SetRange sets the monitored range as returned by parseA1.
+func (rec *Record) SetRange(col1, row1, col2, row2 string) {
+	rec.setKind(KIND_RANGE)
+	if col2 == "" && row2 == "" {
+		col2, row2 = col1, row1
+	}
+	rec.Col1, rec.Row1, rec.Col2, rec.Row2 = col1, row1, col2, row2
+}
+
+func (rec *Record) SetTabs() {
+	rec.setKind(KIND_TABS)
+}
+
+// SetTable sets the columns of a table record. Rows are read from row1, or from the top if it is empty.
+// The key column is set separately.
+func (rec *Record) SetTable(col1, row1, col2 string) {
+	rec.setKind(KIND_TABLE)
+	rec.Col1, rec.Row1, rec.Col2 = col1, row1, col2
+}
+
+// SetLookup makes the record follow the cell in the column titled header and the row where keycol equals keyval.
+func (rec *Record) SetLookup(header, keycol, keyval string) {
+	rec.setKind(KIND_LOOKUP)
+	rec.SetOption("header", header)
+	rec.SetOption("keycol", keycol)
+	rec.SetOption("keyval", keyval)
+}
+
+func (rec *Record) SetOption(key string, value string) {
+	if rec.Options == nil {
+		rec.Options = make(map[string]string)
+	}
+	rec.Options[key] = value
+}
+
+// RangeString formats the range the way users type it, e.g. "A1", "A1:B5" or "C:C".
+func (rec *Record) RangeString() string {
+	if rec.Kind == KIND_TABS {
+		return TABS_STR
+	}
+	if rec.Kind == KIND_TABLE {
+		return rec.Col1 + rec.Row1 + ":" + rec.Col2 + ", rows by " + rec.Options["key"]
+	}
+	if rec.Kind == KIND_LOOKUP {
+		return rec.Options["header"] + ", " + rec.Options["keycol"] + " = " + rec.Options["keyval"]
+	}
+	res := rec.Col1 + rec.Row1
+	if !rec.IsCell() {
+		res += ":" + rec.Col2 + rec.Row2
+	}
+	return res
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+func TestGetTabListKeepsOptions(t *testing.T) {
+	useFetchers(t, map[string]Fetcher{FETCH_HTML: &stubFetcher{testPage}})
+	rec := &Record{Version: RECORD_VERSION, Spreadsheet: "d/abc", Gid: "0"}
+	rec.SetOption("condition", "> 1")
+	rec.SetLookup("Price", "A", "43")
+	if sheet, err := getTabList(rec); sheet == nil || err != nil {
+		t.Fatalf("getTabList: %v, %v", sheet, err)
+	}
+	if rec.Kind != KIND_LOOKUP || rec.Options["header"] != "Price" || rec.Options["keycol"] != "A" ||
+		rec.Options["keyval"] != "43" || rec.Options["condition"] != "> 1" {
+		t.Errorf("record after getTabList = %+v", rec)
+	}
+}
+
+func TestSetKindClearsOptions(t *testing.T) {
+	rec := &Record{Version: RECORD_VERSION}
+	rec.SetOption("fetch", "csv")
+	rec.SetLookup("Price", "A", "43")
+	rec.SetRange("B", "2", "", "")
+	if len(rec.Options) != 1 || rec.Options["fetch"] != "csv" || rec.RangeString() != "B2" {
+		t.Errorf("record = %+v", rec)
+	}
+}
+
+func TestDialogAddLookup(t *testing.T) {
+	fetcher := &blockingFetcher{stubFetcher{testPage}, make(chan struct{})}
+	useFetchers(t, map[string]Fetcher{FETCH_HTML: fetcher})
+	db := newMemoryStorage()
+	rec := &Record{Version: RECORD_VERSION, Spreadsheet: "d/abc", Gid: "0", Kind: KIND_RANGE}
+	db.SetState(1, map[string]string{"name": "add-cell", "record": rec.Encode()}, time.Hour)
+	send := func(text string) *tgbotapi.MessageConfig {
+		return handle(db, &chatMessage{chat: 1, user: 1, text: text})
+	}
+	if reply := send(LOOKUP_STR); reply == nil || !strings.HasPrefix(reply.Text, "Send the title") {
+		t.Fatalf("reply to %s = %v", LOOKUP_STR, reply)
+	}
+	// The update loop does not wait for the table
+	if reply := send("Price, A = 44"); reply != nil {
+		t.Errorf("reply while the table is fetched = %q", reply.Text)
+	}
+	close(fetcher.release)
+	if msg := nextMessage(t); !strings.HasPrefix(msg.Text, "No row where A is 44") {
+		t.Errorf("reply to a missing row = %q", msg.Text)
+	}
+	send("Price, A = 43")
+	if msg := nextMessage(t); !strings.HasPrefix(msg.Text, "Enter the name") {
+		t.Errorf("reply to a found row = %q", msg.Text)
+	}
+	if reply := send("status"); reply == nil || !strings.HasPrefix(reply.Text, "When should I notify you") {
+		t.Errorf("reply to the name = %v", reply)
+	}
+	send("any")
+	if text := initialValue(t); text != "New cell added!\nInitial value: '20'" {
+		t.Errorf("initial value message = %q", text)
+	}
+	value, _ := db.GetRecord(1, "status")
+	saved, _ := decodeRecord(value)
+	if saved == nil || saved.Kind != KIND_LOOKUP || saved.RangeString() != "Price, A = 43" {
+		t.Errorf("saved record = %+v", saved)
+	}
+}
+
+func TestDialogEditLookup(t *testing.T) {
+	useFetchers(t, map[string]Fetcher{FETCH_HTML: &stubFetcher{testPage}})
+	db := newMemoryStorage()
+	rec := &Record{Version: RECORD_VERSION, Spreadsheet: "d/abc", Gid: "0", Kind: KIND_RANGE}
+	rec.SetLookup("Price", "A", "42")
+	rec.SetOption("condition", "> 5")
+	db.AddRecord(1, "status", rec.Encode())
+	db.SetState(1, map[string]string{"name": "edit"}, time.Hour)
+	var replies []*tgbotapi.MessageConfig
+	for _, text := range []string{"1", LOOKUP_STR, "Price, A = 43"} {
+		replies = append(replies, handle(db, &chatMessage{chat: 1, user: 1, text: text}))
+	}
+	if !strings.HasSuffix(replies[0].Text, "Currently: Price, A = 42") || !strings.HasPrefix(replies[1].Text, "Send the title") || replies[2] != nil {
+		t.Errorf("replies = %q, %q, %v", replies[0].Text, replies[1].Text, replies[2])
+	}
+	if text := initialValue(t); text != "New cell added!\nInitial value: '20'" {
+		t.Errorf("initial value message = %q", text)
+	}
+	value, _ := db.GetRecord(1, "status")
+	edited, _ := decodeRecord(value)
+	if edited == nil || edited.Kind != KIND_LOOKUP || edited.RangeString() != "Price, A = 43" || edited.Options["condition"] != "> 5" {
+		t.Errorf("edited record = %+v", edited)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+type redisStorage struct {
+	client   *redis.Client
+	cellLock sync.Mutex
+}
+
+func newRedisStorage(addr string, passwd string) *redisStorage {
+	client := redis.NewClient(&redis.Options{Addr: addr, Password: passwd, DB: 0})
+	_, err := client.Ping().Result()
+	if err != nil {
+		log.Panic(err.Error())
+	}
+	return &redisStorage{client: client}
+}
+
+func (s *redisStorage) RecordExists(uid int64, name string) bool {
+	_, err := s.client.HGet("records/"+strconv.FormatInt(uid, 10), name).Result()
+	return err == nil
+}
+
+func (s *redisStorage) GetRecord(uid int64, name string) (string, bool) {
+	val, err := s.client.HGet("records/"+strconv.FormatInt(uid, 10), name).Result()
+	return val, err == nil
+}
+
+func (s *redisStorage) AddRecord(uid int64, name string, record string) {
+	s.client.HSet("records/"+strconv.FormatInt(uid, 10), name, record)
+}
+
+func (s *redisStorage) RecordList(uid int64) StringPairs {
+	return sortedPairs(s.client.HGetAll("records/" + strconv.FormatInt(uid, 10)).Val())
+}
+
+func (s *redisStorage) DeleteRecord(uid int64, name string) {
+	s.client.HDel("records/"+strconv.FormatInt(uid, 10), name)
+}
+
+func (s *redisStorage) UserList() []int64 {
+	l := s.client.Keys("records/*").Val()
+	res := make([]int64, len(l))
+	for i, v := range l {
+		res[i], _ = strconv.ParseInt(v[8:], 10, 64)
+	}
+	return res
+}
+
+func (s *redisStorage) GetCellVal(uid int64, name string) (string, bool) {
+	val, err := s.client.HGet("cells/"+strconv.FormatInt(uid, 10), name).Result()
+	if err == nil {
+		return val, true
+	} else {
+		return "", false
+	}
+}
+
+func (s *redisStorage) UpdateCellVal(uid int64, name string, value string) string {
+	s.cellLock.Lock()
+	defer s.cellLock.Unlock()
+	old, err := s.client.HGet("cells/"+strconv.FormatInt(uid, 10), name).Result()
+	if err != nil || old != value {
+		s.client.HSet("cells/"+strconv.FormatInt(uid, 10), name, value)
+		if err != nil {
+			return value
+		}
+	}
+	return old
+}
+
+func historyKey(uid int64, name string) string {
+	return "history/" + strconv.FormatInt(uid, 10) + "/" + name
+}
+
+func (s *redisStorage) AddHistory(uid int64, name string, entry HistoryEntry, limit int) {
+	key := historyKey(uid, name)
+	if limit <= 0 {
+		s.client.Del(key)
+		return
+	}
+	data, _ := json.Marshal(entry)
+	s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.RPush(key, data)
+		pipe.LTrim(key, int64(-limit), -1)
+		return nil
+	})
+}
+
+func (s *redisStorage) History(uid int64, name string) []HistoryEntry {
+	res := make([]HistoryEntry, 0)
+	for _, v := range s.client.LRange(historyKey(uid, name), 0, -1).Val() {
+		var entry HistoryEntry
+		if json.Unmarshal([]byte(v), &entry) == nil {
+			res = append(res, entry)
+		}
+	}
+	return res
+}
+
+func (s *redisStorage) DeleteHistory(uid int64, name string) {
+	s.client.Del(historyKey(uid, name))
+}
+
+func (s *redisStorage) GetState(uid int64) map[string]string {
+	return s.client.HGetAll("state/" + strconv.FormatInt(uid, 10)).Val()
+}
+
+func (s *redisStorage) SetState(uid int64, state map[string]string, ttl time.Duration) {
+	key := "state/" + strconv.FormatInt(uid, 10)
+	fields := make(map[string]interface{}, len(state))
+	for k, v := range state {
+		fields[k] = v
+	}
+	s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(key)
+		if len(fields) > 0 {
+			pipe.HMSet(key, fields)
+			pipe.Expire(key, ttl)
+		}
+		return nil
+	})
+}
+
+func (s *redisStorage) DeleteCellVal(uid int64, name string) {
+	s.cellLock.Lock()
+	s.client.HDel("cells/"+strconv.FormatInt(uid, 10), name)
+	s.cellLock.Unlock()
+}
+
+func subscribersKey(rec RecordRef) string {
+	return "subscribers/" + strconv.FormatInt(rec.Uid, 10) + "/" + rec.Name
+}
+
+func (s *redisStorage) AddShare(code string, rec RecordRef) {
+	data, _ := json.Marshal(rec)
+	s.client.HSet("shares", code, data)
+}
+
+func (s *redisStorage) GetShare(code string) (RecordRef, bool) {
+	var rec RecordRef
+	val, err := s.client.HGet("shares", code).Result()
+	if err != nil || json.Unmarshal([]byte(val), &rec) != nil {
+		return rec, false
+	}
+	return rec, true
+}
+
+func (s *redisStorage) DeleteShare(code string) {
+	s.client.HDel("shares", code)
+}
+
+func (s *redisStorage) Subscribe(sub int64, rec RecordRef) {
+	data, _ := json.Marshal(rec)
+	s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.SAdd(subscribersKey(rec), sub)
+		pipe.SAdd("subscriptions/"+strconv.FormatInt(sub, 10), data)
+		return nil
+	})
+}
+
+func (s *redisStorage) Unsubscribe(sub int64, rec RecordRef) {
+	data, _ := json.Marshal(rec)
+	s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.SRem(subscribersKey(rec), sub)
+		pipe.SRem("subscriptions/"+strconv.FormatInt(sub, 10), data)
+		return nil
+	})
+}
+
+func (s *redisStorage) Subscribers(rec RecordRef) []int64 {
+	res := make([]int64, 0)
+	for _, v := range s.client.SMembers(subscribersKey(rec)).Val() {
+		if sub, err := strconv.ParseInt(v, 10, 64); err == nil {
+			res = append(res, sub)
+		}
+	}
+	return res
+}
+
+func (s *redisStorage) Subscriptions(sub int64) []RecordRef {
+	res := make([]RecordRef, 0)
+	for _, v := range s.client.SMembers("subscriptions/" + strconv.FormatInt(sub, 10)).Val() {
+		var rec RecordRef
+		if json.Unmarshal([]byte(v), &rec) == nil {
+			res = append(res, rec)
+		}
+	}
+	return res
+}
+
+func (s *redisStorage) AddOutbox(msg OutboxMessage) {
+	data, _ := json.Marshal(msg)
+	s.client.HSet("outbox", msg.ID, data)
+}
+
+func (s *redisStorage) Outbox() []OutboxMessage {
+	res := make(outboxMessages, 0)
+	for _, v := range s.client.HGetAll("outbox").Val() {
+		var msg OutboxMessage
+		if json.Unmarshal([]byte(v), &msg) == nil {
+			res = append(res, msg)
+		}
+	}
+	sort.Sort(res)
+	return res
+}
+
+func (s *redisStorage) DeleteOutbox(id string) {
+	s.client.HDel("outbox", id)
+}
+
+func (s *redisStorage) SetInactive(chat int64, inactive bool) {
+	if inactive {
+		s.client.SAdd("inactive", chat)
+	} else {
+		s.client.SRem("inactive", chat)
+	}
+}
+
+func (s *redisStorage) IsInactive(chat int64) bool {
+	return s.client.SIsMember("inactive", chat).Val()
+}
@@ -0,0 +1,59 @@
+package main
+
+import "sync"
+
+type userLock struct {
+	sync.Mutex
+	refs int
+}
+
+// sessionLocks hands out one mutex per user, so that the update loop and the goroutines
+// it starts never read and write the same dialog state at once.
+type sessionLocks struct {
+	lock  sync.Mutex
+	users map[int64]*userLock
+}
+
+var sessions = sessionLocks{users: make(map[int64]*userLock)}
+
+func (s *sessionLocks) acquire(uid int64) *userLock {
+	s.lock.Lock()
+	l, ok := s.users[uid]
+	if !ok {
+		l = &userLock{}
+		s.users[uid] = l
+	}
+	l.refs++
+	s.lock.Unlock()
+	l.Lock()
+	return l
+}
+
+func (s *sessionLocks) release(uid int64, l *userLock) {
+	l.Unlock()
+	s.lock.Lock()
+	l.refs--
+	if l.refs == 0 {
+		delete(s.users, uid)
+	}
+	s.lock.Unlock()
+}
+
+// withState loads the dialog state of the user, passes it to fn and saves it afterwards,
+// holding the lock of the user the whole time.
+func withState(db Storage, uid int64, fn func(ustate map[string]string)) {
+	l := sessions.acquire(uid)
+	defer sessions.release(uid, l)
+	ustate := db.GetState(uid)
+	fn(ustate)
+	saveState(db, uid, ustate)
+}
+
+// saveState persists the dialog of the user. Finished dialogs are dropped from the storage.
+func saveState(db Storage, uid int64, ustate map[string]string) {
+	if ustate["name"] == "" {
+		db.SetState(uid, nil, 0)
+		return
+	}
+	db.SetState(uid, ustate, configDuration("statettl"))
+}
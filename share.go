@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"strings"
+)
+
+// newShareCode returns a random invite code. It is short enough for a /start deep link.
+func newShareCode() string {
+	data := make([]byte, 8)
+	rand.Read(data)
+	return hex.EncodeToString(data)
+}
+
+// shareRecord handles "/share <name>" and returns the reply with the invite.
+// A record keeps its code in Options["share"], so sharing it again returns the same code.
+func shareRecord(db Storage, id int64, name string) string {
+	value, ok := db.GetRecord(id, name)
+	if !ok {
+		return "No cell named " + name
+	}
+	rec, err := decodeRecord(value)
+	if err != nil {
+		return "This record is broken, delete it and add again"
+	}
+	code := rec.Options["share"]
+	if code == "" {
+		code = newShareCode()
+		rec.SetOption("share", code)
+		db.AddShare(code, RecordRef{id, name})
+		db.AddRecord(id, name, rec.Encode())
+	}
+	return "Send this to the people who should get the notifications about " + name + ":\n" +
+		"https://t.me/" + botUser.UserName + "?start=" + code + "\n\n" +
+		"Or they can send me /start " + code + "\nTo stop sharing, use /unshare " + name
+}
+
+// unshareRecord handles "/unshare <name>". The invite code stops working and all subscribers are dropped.
+func unshareRecord(db Storage, id int64, name string) string {
+	value, ok := db.GetRecord(id, name)
+	if !ok {
+		return "No cell named " + name
+	}
+	rec, err := decodeRecord(value)
+	if err != nil {
+		return "This record is broken, delete it and add again"
+	}
+	dropShare(db, id, name, rec.Options["share"])
+	delete(rec.Options, "share")
+	db.AddRecord(id, name, rec.Encode())
+	return "Ok"
+}
+
+// dropShare deletes the invite code and the subscribers of the record.
+func dropShare(db Storage, id int64, name string, code string) {
+	if code != "" {
+		db.DeleteShare(code)
+	}
+	ref := RecordRef{id, name}
+	for _, sub := range db.Subscribers(ref) {
+		db.Unsubscribe(sub, ref)
+	}
+}
+
+// subscribe handles "/start <code>".
+func subscribe(db Storage, id int64, code string) string {
+	ref, ok := db.GetShare(code)
+	if !ok {
+		return "This invite does not work anymore"
+	}
+	if ref.Uid == id {
+		return "This cell is already yours"
+	}
+	db.Subscribe(id, ref)
+	// Records of different owners may have the same name, the code tells them apart
+	stop := ref.Name
+	if len(subscriptionsNamed(db, id, ref.Name)) > 1 {
+		stop = code
+	}
+	return "You will get the notifications about " + ref.Name + ". Use /unsubscribe " + stop + " to stop"
+}
+
+// subscriptionsNamed returns the records with this name shared with the chat.
+func subscriptionsNamed(db Storage, id int64, name string) []RecordRef {
+	var res []RecordRef
+	for _, ref := range db.Subscriptions(id) {
+		if ref.Name == name {
+			res = append(res, ref)
+		}
+	}
+	return res
+}
+
+// unsubscribe handles "/unsubscribe <name>" and "/unsubscribe <code>".
+// A name is only accepted if a single record with it is shared with the chat.
+func unsubscribe(db Storage, id int64, name string) string {
+	if ref, ok := db.GetShare(name); ok {
+		for _, v := range db.Subscriptions(id) {
+			if v == ref {
+				db.Unsubscribe(id, ref)
+				return "Ok"
+			}
+		}
+	}
+	refs := subscriptionsNamed(db, id, name)
+	switch len(refs) {
+	case 0:
+		return "You are not subscribed to " + name
+	case 1:
+		db.Unsubscribe(id, refs[0])
+		return "Ok"
+	}
+	return "Several cells named " + name + " are shared with you. Use /unsubscribe with the code from the invite"
+}
+
+// formatSubscriptions lists the records shared with the chat, or returns an empty string if there are none.
+func formatSubscriptions(db Storage, id int64) string {
+	var names []string
+	for _, ref := range db.Subscriptions(id) {
+		names = append(names, ref.Name)
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	sort.Strings(names)
+	return "Shared with you:\n" + strings.Join(names, "\n") + "\n\nUse /unsubscribe <name> to stop getting notifications"
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// addShared adds a record of the owner and returns its invite code.
+func addShared(t *testing.T, db Storage, owner int64, name string) string {
+	db.AddRecord(owner, name, (&Record{Version: RECORD_VERSION, Kind: KIND_TABS}).Encode())
+	shareRecord(db, owner, name)
+	value, _ := db.GetRecord(owner, name)
+	rec, err := decodeRecord(value)
+	if err != nil || rec.Options["share"] == "" {
+		t.Fatalf("shared record = %+v, %v", rec, err)
+	}
+	return rec.Options["share"]
+}
+
+func TestShareRecord(t *testing.T) {
+	useChats(t)
+	db := newMemoryStorage()
+	code := addShared(t, db, 1, "kpi")
+	tests := []struct {
+		id   int64
+		name string
+		want string
+	}{
+		{1, "kpi", "https://t.me/MonBot?start=" + code},
+		{1, "nope", "No cell named nope"},
+		{2, "kpi", "No cell named kpi"},
+	}
+	for _, test := range tests {
+		if reply := shareRecord(db, test.id, test.name); !strings.Contains(reply, test.want) {
+			t.Errorf("shareRecord(%d, %s) = %q, want %q", test.id, test.name, reply, test.want)
+		}
+	}
+	if ref, ok := db.GetShare(code); !ok || ref != (RecordRef{1, "kpi"}) {
+		t.Errorf("GetShare(%s) = %v, %v", code, ref, ok)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	useChats(t)
+	db := newMemoryStorage()
+	code := addShared(t, db, 1, "kpi")
+	tests := []struct {
+		id   int64
+		code string
+		want string
+	}{
+		{2, code, "You will get the notifications about kpi. Use /unsubscribe kpi to stop"},
+		{2, code, "You will get the notifications about kpi"},
+		{3, code, "You will get the notifications about kpi"},
+		{1, code, "This cell is already yours"},
+		{2, "0000", "This invite does not work anymore"},
+	}
+	for _, test := range tests {
+		if reply := subscribe(db, test.id, test.code); !strings.HasPrefix(reply, test.want) {
+			t.Errorf("subscribe(%d, %s) = %q, want %q", test.id, test.code, reply, test.want)
+		}
+	}
+	if subs := db.Subscribers(RecordRef{1, "kpi"}); len(subs) != 2 {
+		t.Errorf("subscribers = %v, want 2 and 3", subs)
+	}
+	if shared := formatSubscriptions(db, 2); !strings.HasPrefix(shared, "Shared with you:\nkpi\n") {
+		t.Errorf("formatSubscriptions(2) = %q", shared)
+	}
+	if shared := formatSubscriptions(db, 1); shared != "" {
+		t.Errorf("formatSubscriptions(1) = %q, want none", shared)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	useChats(t)
+	db := newMemoryStorage()
+	first := addShared(t, db, 1, "kpi")
+	second := addShared(t, db, 3, "kpi")
+	other := addShared(t, db, 3, "sales")
+	subscribe(db, 2, first)
+	if reply := subscribe(db, 2, second); !strings.HasSuffix(reply, "Use /unsubscribe "+second+" to stop") {
+		t.Errorf("reply to a second subscription to kpi = %q", reply)
+	}
+	subscribe(db, 2, other)
+	tests := []struct {
+		arg  string
+		want string
+		left int
+	}{
+		{"kpi", "Several cells named kpi are shared with you", 3},
+		{"nope", "You are not subscribed to nope", 3},
+		{second, "Ok", 2},
+		{second, "You are not subscribed to " + second, 2},
+		{"kpi", "Ok", 1},
+		{"kpi", "You are not subscribed to kpi", 1},
+		{other, "Ok", 0},
+	}
+	for _, test := range tests {
+		if reply := unsubscribe(db, 2, test.arg); !strings.HasPrefix(reply, test.want) {
+			t.Errorf("unsubscribe(%s) = %q, want %q", test.arg, reply, test.want)
+		}
+		if refs := db.Subscriptions(2); len(refs) != test.left {
+			t.Errorf("after unsubscribe(%s) subscriptions = %v, want %d", test.arg, refs, test.left)
+		}
+	}
+	if subs := db.Subscribers(RecordRef{1, "kpi"}); len(subs) != 0 {
+		t.Errorf("subscribers of the first kpi = %v", subs)
+	}
+}
+
+func TestDropShare(t *testing.T) {
+	useChats(t)
+	tests := []struct {
+		name string
+		drop func(db Storage)
+	}{
+		{"unshare", func(db Storage) {
+			if reply := unshareRecord(db, 1, "kpi"); reply != "Ok" {
+				t.Errorf("unshareRecord = %q", reply)
+			}
+		}},
+		{"delete", func(db Storage) {
+			if replies := runSteps(db, map[string]string{"name": "delete"}, "1"); replies[0].Text != "Deleted!" {
+				t.Errorf("delete reply = %q", replies[0].Text)
+			}
+		}},
+	}
+	for _, test := range tests {
+		db := newMemoryStorage()
+		code := addShared(t, db, 1, "kpi")
+		subscribe(db, 2, code)
+		subscribe(db, 3, code)
+		test.drop(db)
+		if _, ok := db.GetShare(code); ok {
+			t.Errorf("%s: the invite still works", test.name)
+		}
+		if subs := db.Subscribers(RecordRef{1, "kpi"}); len(subs) != 0 {
+			t.Errorf("%s: subscribers = %v", test.name, subs)
+		}
+		for _, id := range []int64{2, 3} {
+			if refs := db.Subscriptions(id); len(refs) != 0 {
+				t.Errorf("%s: subscriptions of %d = %v", test.name, id, refs)
+			}
+		}
+	}
+	db := newMemoryStorage()
+	code := addShared(t, db, 1, "kpi")
+	subscribe(db, 2, code)
+	unshareRecord(db, 1, "kpi")
+	if reply := shareRecord(db, 1, "kpi"); strings.Contains(reply, code) {
+		t.Errorf("sharing again returned the revoked code: %q", reply)
+	}
+}
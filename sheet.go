@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Sheet is a parsed spreadsheet document.
+type Sheet struct {
+	// Tabs are the tabs in the order they are listed in the document.
+	Tabs  []*Tab
+	byGid map[string]*Tab
+}
+
+// Tab is a single page of a document.
+type Tab struct {
+	Gid  string
+	Name string
+	// Rows and Cols are the labels of the visible rows and columns, e.g. "5" and "C".
+	// They differ from the positions when some rows or columns are hidden.
+	Rows []string
+	Cols []string
+	// Cells[r][c] is the cell at the 0-based visible position (r, c).
+	// Positions covered by a merged cell and positions past the end of a row are nil.
+	// Cells is nil if the tab is listed but its contents are missing from the document.
+	Cells [][]*Cell
+}
+
+type Cell struct {
+	Text string
+	// RowSpan and ColSpan are greater than 1 for merged cells. The cell is stored
+	// at the top-left position of the merged area.
+	RowSpan int
+	ColSpan int
+}
+
+func (s *Sheet) Tab(gid string) *Tab {
+	return s.byGid[gid]
+}
+
+// rowIndex returns the 1-based visible position of the row labelled row.
+// Unknown labels are treated as plain row numbers.
+func (t *Tab) rowIndex(row string) int {
+	for i, label := range t.Rows {
+		if label == row {
+			return i + 1
+		}
+	}
+	res, _ := strconv.Atoi(row)
+	return res
+}
+
+// colIndex returns the 1-based visible position of the column labelled col.
+// Unknown labels are converted with colToInt.
+func (t *Tab) colIndex(col string) int {
+	for i, label := range t.Cols {
+		if label == col {
+			return i + 1
+		}
+	}
+	return colToInt(col)
+}
+
+// rowLabel returns the label of the row at the 1-based visible position.
+func (t *Tab) rowLabel(x int) string {
+	if x >= 1 && x <= len(t.Rows) {
+		return t.Rows[x-1]
+	}
+	return strconv.Itoa(x)
+}
+
+// colLabel returns the label of the column at the 1-based visible position.
+func (t *Tab) colLabel(y int) string {
+	if y >= 1 && y <= len(t.Cols) {
+		return t.Cols[y-1]
+	}
+	return intToCol(y)
+}
+
+// width returns the number of columns of the widest row.
+func (t *Tab) width() int {
+	res := len(t.Cols)
+	for _, row := range t.Cells {
+		if len(row) > res {
+			res = len(row)
+		}
+	}
+	return res
+}
+
+// bounds converts the labels of the ends of a range to positions. An empty first label
+// means the start of the tab and an empty second label means its end.
+func (t *Tab) bounds(index func(string) int, label1 string, label2 string, size int) (int, int) {
+	i1, i2 := 1, size
+	if label1 != "" {
+		i1 = index(label1)
+	}
+	if label2 != "" {
+		i2 = index(label2)
+	}
+	if label1 != "" && label2 != "" && i1 > i2 {
+		i1, i2 = i2, i1
+	}
+	return i1, i2
+}
+
+// TabByName returns the tab with the name, ignoring the case if there is no exact match.
+func (s *Sheet) TabByName(name string) *Tab {
+	for _, tab := range s.Tabs {
+		if tab.Name == name {
+			return tab
+		}
+	}
+	for _, tab := range s.Tabs {
+		if strings.EqualFold(tab.Name, name) {
+			return tab
+		}
+	}
+	return nil
+}
+
+// cell returns the cell at the 1-based visible position, or nil if there is none.
+func (t *Tab) cell(x int, y int) *Cell {
+	if x < 1 || x > len(t.Cells) || y < 1 || y > len(t.Cells[x-1]) {
+		return nil
+	}
+	return t.Cells[x-1][y-1]
+}
+
+func getPageList(sheet *Sheet) (names []string, gids []string) {
+	if sheet == nil {
+		return nil, nil
+	}
+	for _, tab := range sheet.Tabs {
+		names = append(names, tab.Name)
+		gids = append(gids, tab.Gid)
+	}
+	return
+}
+
+// getTabsValue returns the stored value of a tab list record.
+func getTabsValue(sheet *Sheet) *string {
+	names, gids := getPageList(sheet)
+	if names == nil {
+		return nil
+	}
+	value := &TabsValue{}
+	for i := range names {
+		value.Tabs = append(value.Tabs, TabInfo{Gid: gids[i], Name: names[i]})
+	}
+	res := value.Encode()
+	return &res
+}
+
+// extractRange returns the cells between the two corners. Positions covered by merged cells are nil.
+// Empty rows and columns extend the range to the edges of the tab, so that it follows the tab as it grows.
+func extractRange(sheet *Sheet, gid string, row1 string, col1 string, row2 string, col2 string) (*RangeValue, error) {
+	g := sheet.Tab(gid)
+	if g == nil || g.Cells == nil {
+		return nil, errors.New("Page " + gid + " does not exist")
+	}
+	x1, x2 := g.bounds(g.rowIndex, row1, row2, len(g.Cells))
+	y1, y2 := g.bounds(g.colIndex, col1, col2, g.width())
+	res := &RangeValue{}
+	for x := x1; x <= x2; x++ {
+		res.Rows = append(res.Rows, g.rowLabel(x))
+		row := make([]*string, 0, y2-y1+1)
+		for y := y1; y <= y2; y++ {
+			if c := g.cell(x, y); c != nil {
+				text := c.Text
+				row = append(row, &text)
+			} else {
+				row = append(row, nil)
+			}
+		}
+		res.Cells = append(res.Cells, row)
+	}
+	for y := y1; y <= y2; y++ {
+		res.Cols = append(res.Cols, g.colLabel(y))
+	}
+	return res, nil
+}
+
+// extractCellValue returns the value of a cell or a range in the format it is stored in.
+func extractCellValue(sheet *Sheet, gid string, row1 string, col1 string, row2 string, col2 string) (string, error) {
+	value, err := extractRange(sheet, gid, row1, col1, row2, col2)
+	if err != nil {
+		return "", err
+	}
+	if isCell(col1, row1, col2, row2) {
+		if len(value.Cells) == 0 || len(value.Cells[0]) == 0 || value.Cells[0][0] == nil {
+			return "", nil
+		}
+		return *value.Cells[0][0], nil
+	}
+	return value.Encode(), nil
+}
+
+// extractTable returns the rows of the columns col1 to col2 from row1 down to the end of the tab.
+// Rows with an empty key are skipped.
+func extractTable(sheet *Sheet, gid string, row1 string, col1 string, col2 string, key string) (*TableValue, error) {
+	g := sheet.Tab(gid)
+	if g == nil || g.Cells == nil {
+		return nil, errors.New("Page " + gid + " does not exist")
+	}
+	x1 := 1
+	if row1 != "" {
+		x1 = g.rowIndex(row1)
+	}
+	y1, y2 := g.colIndex(col1), g.colIndex(col2)
+	if y1 > y2 {
+		y1, y2 = y2, y1
+	}
+	k := g.colIndex(key)
+	if k < y1 || k > y2 {
+		return nil, errors.New("Key column " + key + " is outside of the table")
+	}
+	res := &TableValue{Key: key}
+	for y := y1; y <= y2; y++ {
+		res.Cols = append(res.Cols, g.colLabel(y))
+	}
+	seen := make(map[string]int)
+	for x := x1; x <= len(g.Cells); x++ {
+		row := make([]string, 0, y2-y1+1)
+		for y := y1; y <= y2; y++ {
+			if c := g.cell(x, y); c != nil {
+				row = append(row, c.Text)
+			} else {
+				row = append(row, "")
+			}
+		}
+		name := row[k-y1]
+		if name == "" {
+			continue
+		}
+		// Rows with the same key are told apart by their order.
+		seen[name]++
+		if seen[name] > 1 {
+			name += " (" + strconv.Itoa(seen[name]) + ")"
+		}
+		res.Keys = append(res.Keys, name)
+		res.Rows = append(res.Rows, row)
+	}
+	return res, nil
+}
+
+// lookupCell finds the cell in the column titled header and in the row where the column keycol holds keyval.
+// The titles are read from the first row of the tab.
+func lookupCell(sheet *Sheet, gid string, header string, keycol string, keyval string) (string, error) {
+	g := sheet.Tab(gid)
+	if g == nil || g.Cells == nil {
+		return "", errors.New("Page " + gid + " does not exist")
+	}
+	col := 0
+	if len(g.Cells) > 0 {
+		for y, c := range g.Cells[0] {
+			if c != nil && strings.TrimSpace(c.Text) == header {
+				col = y + 1
+				break
+			}
+		}
+	}
+	if col == 0 {
+		return "", errors.New("No column titled " + header)
+	}
+	k := g.colIndex(keycol)
+	for x := 1; x <= len(g.Cells); x++ {
+		if c := g.cell(x, k); c != nil && strings.TrimSpace(c.Text) == keyval {
+			if res := g.cell(x, col); res != nil {
+				return res.Text, nil
+			}
+			return "", nil
+		}
+	}
+	return "", errors.New("No row where " + keycol + " is " + keyval)
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SHEETS_SCOPE = "https://www.googleapis.com/auth/spreadsheets.readonly"
+
+// apiDocument is what the Sheets API fetcher stores in the cache: the layout of the document
+// and the values of a single tab.
+type apiDocument struct {
+	Sheets []apiSheet `json:"sheets"`
+	Values [][]string `json:"values"`
+}
+
+type apiSheet struct {
+	Properties struct {
+		SheetID        int64  `json:"sheetId"`
+		Title          string `json:"title"`
+		GridProperties struct {
+			RowCount    int `json:"rowCount"`
+			ColumnCount int `json:"columnCount"`
+		} `json:"gridProperties"`
+	} `json:"properties"`
+	Merges []struct {
+		StartRowIndex    int `json:"startRowIndex"`
+		EndRowIndex      int `json:"endRowIndex"`
+		StartColumnIndex int `json:"startColumnIndex"`
+		EndColumnIndex   int `json:"endColumnIndex"`
+	} `json:"merges"`
+	Data []struct {
+		RowMetadata    []apiDimension `json:"rowMetadata"`
+		ColumnMetadata []apiDimension `json:"columnMetadata"`
+	} `json:"data"`
+}
+
+type apiDimension struct {
+	HiddenByUser   bool `json:"hiddenByUser"`
+	HiddenByFilter bool `json:"hiddenByFilter"`
+}
+
+func (d apiDimension) hidden() bool {
+	return d.HiddenByUser || d.HiddenByFilter
+}
+
+// serviceAccount is the part of a service account key file needed to get access tokens.
+type serviceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+
+	lock    sync.Mutex
+	key     *rsa.PrivateKey
+	token   string
+	expires time.Time
+}
+
+func loadServiceAccount(path string) (*serviceAccount, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var acc serviceAccount
+	if err := json.Unmarshal(data, &acc); err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(acc.PrivateKey))
+	if block == nil {
+		return nil, errors.New("No private key in " + path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("The private key in " + path + " is not an RSA key")
+	}
+	acc.key = rsaKey
+	if acc.TokenURI == "" {
+		acc.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return &acc, nil
+}
+
+// accessToken returns a cached OAuth token, exchanging a signed JWT for a new one when it expires.
+func (acc *serviceAccount) accessToken(client *httpClient) (string, error) {
+	acc.lock.Lock()
+	defer acc.lock.Unlock()
+	if acc.token != "" && time.Now().Before(acc.expires) {
+		return acc.token, nil
+	}
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   acc.ClientEmail,
+		"scope": SHEETS_SCOPE,
+		"aud":   acc.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, acc.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)},
+	}
+	req, err := http.NewRequest("POST", acc.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = client.do(req, func(resp *http.Response) error {
+		if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+			return err
+		}
+		if resp.StatusCode != 200 || token.AccessToken == "" {
+			return errors.New("Could not get an access token: " + resp.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	acc.token = token.AccessToken
+	acc.expires = now.Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return acc.token, nil
+}
+
+// apiFetcher reads documents through the Sheets API, authorized either with an API key
+// or with a service account. Unlike the other fetchers it can read private documents
+// shared with the service account.
+type apiFetcher struct {
+	http    *httpClient
+	baseURL string
+	apiKey  string
+	account *serviceAccount
+}
+
+func newAPIFetcher(client *httpClient, baseURL string, apiKey string, credentials string) *apiFetcher {
+	f := &apiFetcher{http: client, baseURL: strings.TrimSuffix(baseURL, "/"), apiKey: apiKey}
+	if credentials != "" {
+		acc, err := loadServiceAccount(credentials)
+		if err != nil {
+			log.Panic(err.Error())
+		}
+		f.account = acc
+	}
+	return f
+}
+
+// get performs an authorized GET request to the Sheets API and decodes the JSON response.
+func (f *apiFetcher) get(path string, params url.Values, v interface{}) error {
+	if f.account == nil {
+		params.Set("key", f.apiKey)
+	}
+	req, err := http.NewRequest("GET", f.baseURL+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if f.account != nil {
+		token, err := f.account.accessToken(f.http)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return f.http.do(req, func(resp *http.Response) error {
+		if resp.StatusCode != 200 {
+			return errors.New("Sheets API request failed: " + resp.Status)
+		}
+		return json.NewDecoder(resp.Body).Decode(v)
+	})
+}
+
+// apiSpreadsheetID extracts the id of the document from its path. Documents opened
+// through /pubhtml have a different id that the API does not know.
+func apiSpreadsheetID(name string) (string, error) {
+	if strings.HasSuffix(name, "/pubhtml") || strings.HasPrefix(name, "d/e/") {
+		return "", errors.New("Published documents cannot be read through the Sheets API")
+	}
+	parts := strings.Split(name, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] == "d" {
+			return parts[i+1], nil
+		}
+	}
+	return "", errors.New("Unknown document path " + name)
+}
+
+// Fetch reads the layout of the document and, unless gid is empty, the values of that tab.
+// The result is stored as a JSON encoded apiDocument. The API does not support
+// conditional requests, so the validators are ignored.
+func (f *apiFetcher) Fetch(name string, gid string, etag string, lastModified string) (*tableEntry, bool) {
+	entry, err := f.fetch(name, gid)
+	if err != nil {
+		log.Println("Unable to fetch " + name + " through the Sheets API: " + err.Error())
+	}
+	return entry, false
+}
+
+func (f *apiFetcher) Parse(gid string, data string) (*Sheet, error) {
+	return parseAPISheet(gid, data)
+}
+
+func (f *apiFetcher) fetch(name string, gid string) (*tableEntry, error) {
+	id, err := apiSpreadsheetID(name)
+	if err != nil {
+		return nil, err
+	}
+	var doc apiDocument
+	err = f.get("/v4/spreadsheets/"+url.PathEscape(id), url.Values{
+		"fields": {"sheets(properties(sheetId,title,gridProperties(rowCount,columnCount)),merges,data(rowMetadata(hiddenByUser,hiddenByFilter),columnMetadata(hiddenByUser)))"},
+	}, &doc)
+	if err != nil {
+		return nil, err
+	}
+	if gid != "" {
+		title := ""
+		for _, s := range doc.Sheets {
+			if strconv.FormatInt(s.Properties.SheetID, 10) == gid {
+				title = s.Properties.Title
+			}
+		}
+		if title == "" {
+			return nil, errors.New("Page " + gid + " does not exist")
+		}
+		var values struct {
+			Values [][]string `json:"values"`
+		}
+		err = f.get("/v4/spreadsheets/"+url.PathEscape(id)+"/values/"+url.PathEscape("'"+strings.Replace(title, "'", "''", -1)+"'"), url.Values{
+			"majorDimension": {"ROWS"},
+		}, &values)
+		if err != nil {
+			return nil, err
+		}
+		doc.Values = values.Values
+	}
+	data, _ := json.Marshal(doc)
+	return &tableEntry{data: string(data), fetched: time.Now()}, nil
+}
+
+// parseAPISheet builds the grid model out of an apiDocument. Hidden rows and columns are
+// skipped and merged areas are resolved the same way as in the HTML view.
+func parseAPISheet(gid string, data string) (*Sheet, error) {
+	var doc apiDocument
+	if err := json.Unmarshal([]byte(data), &doc); err != nil {
+		return nil, err
+	}
+	sheet := &Sheet{byGid: make(map[string]*Tab)}
+	for _, s := range doc.Sheets {
+		tab := &Tab{Gid: strconv.FormatInt(s.Properties.SheetID, 10), Name: s.Properties.Title}
+		sheet.Tabs = append(sheet.Tabs, tab)
+		sheet.byGid[tab.Gid] = tab
+		if tab.Gid != gid {
+			continue
+		}
+		var rowMeta, colMeta []apiDimension
+		if len(s.Data) > 0 {
+			rowMeta, colMeta = s.Data[0].RowMetadata, s.Data[0].ColumnMetadata
+		}
+		isHidden := func(meta []apiDimension, i int) bool {
+			return i < len(meta) && meta[i].hidden()
+		}
+		covered := make(map[[2]int]bool)
+		spans := make(map[[2]int][2]int)
+		for _, m := range s.Merges {
+			spans[[2]int{m.StartRowIndex, m.StartColumnIndex}] = [2]int{m.EndRowIndex - m.StartRowIndex, m.EndColumnIndex - m.StartColumnIndex}
+			for r := m.StartRowIndex; r < m.EndRowIndex; r++ {
+				for c := m.StartColumnIndex; c < m.EndColumnIndex; c++ {
+					if r != m.StartRowIndex || c != m.StartColumnIndex {
+						covered[[2]int{r, c}] = true
+					}
+				}
+			}
+		}
+		// The API omits trailing empty cells and rows, while the HTML view shows the whole grid.
+		width, height := s.Properties.GridProperties.ColumnCount, s.Properties.GridProperties.RowCount
+		for _, row := range doc.Values {
+			if len(row) > width {
+				width = len(row)
+			}
+		}
+		if len(doc.Values) > height {
+			height = len(doc.Values)
+		}
+		for c := 0; c < width; c++ {
+			if !isHidden(colMeta, c) {
+				tab.Cols = append(tab.Cols, intToCol(c+1))
+			}
+		}
+		tab.Cells = make([][]*Cell, 0, height)
+		for r := 0; r < height; r++ {
+			if isHidden(rowMeta, r) {
+				continue
+			}
+			var values []string
+			if r < len(doc.Values) {
+				values = doc.Values[r]
+			}
+			tab.Rows = append(tab.Rows, strconv.Itoa(r+1))
+			var row []*Cell
+			for c := 0; c < width; c++ {
+				if isHidden(colMeta, c) {
+					continue
+				}
+				if covered[[2]int{r, c}] {
+					row = append(row, nil)
+					continue
+				}
+				cell := &Cell{RowSpan: 1, ColSpan: 1}
+				if c < len(values) {
+					cell.Text = values[c]
+				}
+				if span, ok := spans[[2]int{r, c}]; ok {
+					cell.RowSpan, cell.ColSpan = span[0], span[1]
+				}
+				row = append(row, cell)
+			}
+			tab.Cells = append(tab.Cells, row)
+		}
+	}
+	return sheet, nil
+}
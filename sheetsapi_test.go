@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testLayout has the tabs "First" (gid 0) and "It's" (gid 77). On the second tab
+// row 2 is hidden and A3:B3 are merged.
+const testLayout = `{"sheets":[
+	{"properties":{"sheetId":0,"title":"First","gridProperties":{"rowCount":1,"columnCount":1}}},
+	{"properties":{"sheetId":77,"title":"It's","gridProperties":{"rowCount":4,"columnCount":3}},
+	 "merges":[{"startRowIndex":2,"endRowIndex":3,"startColumnIndex":0,"endColumnIndex":2}],
+	 "data":[{"rowMetadata":[{},{"hiddenByUser":true}],"columnMetadata":[]}]}]}`
+
+const testValues = `{"values":[["a1","b1","c1"],["a2","b2"],["a3"],[]]}`
+
+// sheetsStandIn serves the Sheets API for the document "abc". authorized checks every request.
+func sheetsStandIn(t *testing.T, authorized func(r *http.Request) bool) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		switch r.URL.EscapedPath() {
+		case "/v4/spreadsheets/abc":
+			if !strings.Contains(r.URL.Query().Get("fields"), "merges") {
+				t.Errorf("layout is requested without merges: %s", r.URL)
+			}
+			w.Write([]byte(testLayout))
+		case "/v4/spreadsheets/abc/values/%27It%27%27s%27":
+			w.Write([]byte(testValues))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func testClient() *httpClient {
+	return newHTTPClient(5*time.Second, "", "spreadmon-test", 2)
+}
+
+func TestAPIFetcherKey(t *testing.T) {
+	srv := sheetsStandIn(t, func(r *http.Request) bool {
+		return r.URL.Query().Get("key") == "secret-key"
+	})
+	f := newAPIFetcher(testClient(), srv.URL+"/", "secret-key", "")
+	entry, _ := f.Fetch("d/abc", "77", "", "")
+	if entry == nil {
+		t.Fatal("Fetch failed")
+	}
+	sheet, err := f.Parse("77", entry.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sheet.Tabs) != 2 || sheet.Tabs[1].Name != "It's" {
+		t.Fatalf("tabs = %v", sheet.Tabs)
+	}
+	if v, err := extractCellValue(sheet, "77", "3", "A", "3", "A"); err != nil || v != "a3" {
+		t.Errorf("A3 = %q, %v", v, err)
+	}
+	if v, err := extractCellValue(sheet, "77", "1", "C", "1", "C"); err != nil || v != "c1" {
+		t.Errorf("C1 = %q, %v", v, err)
+	}
+	if entry, _ := f.Fetch("d/abc", "5", "", ""); entry != nil {
+		t.Error("a missing tab is fetched")
+	}
+	if entry, _ := newAPIFetcher(testClient(), srv.URL, "wrong", "").Fetch("d/abc", "", "", ""); entry != nil {
+		t.Error("a request with a wrong key is accepted")
+	}
+	if entry, _ := f.Fetch("d/e/abc/pubhtml", "", "", ""); entry != nil {
+		t.Error("a published document is fetched")
+	}
+}
+
+func TestParseAPISheet(t *testing.T) {
+	data := strings.TrimSuffix(testLayout, "}") + `,"values":[["a1","b1","c1"],["a2","b2"],["a3"]]}`
+	sheet, err := parseAPISheet("77", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tab := sheet.Tab("77")
+	if !reflect.DeepEqual(tab.Rows, []string{"1", "3", "4"}) || !reflect.DeepEqual(tab.Cols, []string{"A", "B", "C"}) {
+		t.Errorf("rows = %v, cols = %v", tab.Rows, tab.Cols)
+	}
+	merged := tab.Cells[1]
+	if merged[0] == nil || merged[0].Text != "a3" || merged[0].ColSpan != 2 || merged[1] != nil {
+		t.Errorf("merged row = %v", merged)
+	}
+	if first := sheet.Tab("0"); first == nil || first.Cells != nil {
+		t.Errorf("the other tab = %+v, want it listed without cells", first)
+	}
+	if _, err := parseAPISheet("0", "not json"); err == nil {
+		t.Error("a broken document is parsed")
+	}
+}
+
+func TestAPIFetcherServiceAccount(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exchanges int32
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&exchanges, 1)
+		r.ParseForm()
+		parts := strings.Split(r.PostForm.Get("assertion"), ".")
+		if r.PostForm.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || len(parts) != 3 {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], sig) != nil {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var c map[string]interface{}
+		json.Unmarshal(claims, &c)
+		if c["iss"] != "bot@example.com" || c["scope"] != SHEETS_SCOPE {
+			t.Errorf("claims = %v", c)
+		}
+		w.Write([]byte(`{"access_token":"tok","expires_in":3600}`))
+	}))
+	defer tokens.Close()
+	srv := sheetsStandIn(t, func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "Bearer tok" && r.URL.Query().Get("key") == ""
+	})
+
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	credentials, _ := json.Marshal(map[string]string{
+		"client_email": "bot@example.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    tokens.URL + "/token",
+	})
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	if err := ioutil.WriteFile(path, credentials, 0600); err != nil {
+		t.Fatal(err)
+	}
+	f := newAPIFetcher(testClient(), srv.URL, "", path)
+	for i := 0; i < 2; i++ {
+		if entry, _ := f.Fetch("d/abc", "77", "", ""); entry == nil {
+			t.Fatalf("Fetch %d failed", i)
+		}
+	}
+	if n := atomic.LoadInt32(&exchanges); n != 1 {
+		t.Errorf("the token was exchanged %d times, want once", n)
+	}
+}
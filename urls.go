@@ -1,68 +1,79 @@
 package main
 
 import (
-	"io/ioutil"
-	"log"
-	"net/http"
 	"regexp"
 	"strings"
 )
 
-var URL_RE, _ = regexp.Compile(`https?://docs.google.com/spreadsheets/(.*)/(?:edit|htmlview|(pubhtml))(?:\?[^#]*)?#?(?:gid=(\d*)(?:&range=([A-Z]+)(\d+)(?:\:([A-Z]+)(\d+))?)?)?$`)
-var CELL_RE, _ = regexp.Compile(`^([A-Z]+)(\d+)(?:\:([A-Z]+)(\d+))?$`)
+var URL_RE, _ = regexp.Compile(`https?://docs.google.com/spreadsheets/(.*)/(?:edit|htmlview|(pubhtml))(?:\?[^#]*)?#?(?:gid=(\d*)(?:&range=([A-Z0-9:]+))?)?$`)
 
-const DATA_LENGTH = 6
+// CELL_RE matches A1 notation: a cell (A1), a range (A1:B5), whole columns (C:C), whole rows (3:3)
+// and open-ended ranges (A2:A), optionally prefixed with a tab name ('Sheet 2'!A1:B3).
+var CELL_RE, _ = regexp.Compile(`^(?:('(?:[^']|'')+'|[^'!]+)!)?([A-Z]*)(\d*)(?:(\:)([A-Z]*)(\d*))?$`)
+var TABLE_RE, _ = regexp.Compile(`^([A-Z]+)(\d*)\:([A-Z]+)$`)
+var LOOKUP_RE, _ = regexp.Compile(`^(.+?)\s*,\s*([A-Za-z]+)\s*=\s*(.+)$`)
+var COLUMN_RE, _ = regexp.Compile(`^[A-Z]+$`)
 
-func parseURL(url string) []string {
+func parseURL(url string) *Record {
 	res := URL_RE.FindStringSubmatch(url)
-	if len(res) > 0 {
-		res = res[1:]
-		if res[1] == "pubhtml" {
-			res[0] += "/pubhtml"
-		}
-		res = append(res[:1], res[2:]...)
-		if res[4] == "" {
-			res[4] = res[2]
-		}
-		if res[5] == "" {
-			res[5] = res[3]
-		}
-		return res
-	} else {
+	if len(res) == 0 {
 		return nil
 	}
+	rec := &Record{Version: RECORD_VERSION, Spreadsheet: res[1], Published: res[2] == "pubhtml", Gid: res[3], Kind: KIND_RANGE}
+	if res[4] != "" {
+		tab, col1, row1, col2, row2, ok := parseA1(res[4])
+		if !ok || tab != "" {
+			return nil
+		}
+		rec.SetRange(col1, row1, col2, row2)
+	}
+	return rec
 }
 
-func buildEditURL(data []string) string {
-	if len(data) != DATA_LENGTH {
-		return ""
+// parseA1 splits a range in A1 notation. Empty rows mean that the range goes on to the edge of the tab,
+// and empty columns mean whole rows. For a single cell, col2 and row2 are empty.
+func parseA1(s string) (tab, col1, row1, col2, row2 string, ok bool) {
+	if i := strings.LastIndex(s, "!"); i >= 0 {
+		s = s[:i+1] + strings.ToUpper(s[i+1:])
+	} else {
+		s = strings.ToUpper(s)
 	}
-	if data[2] == "tabs" {
-		if strings.HasSuffix(data[0], "/pubhtml") {
-			return "https://docs.google.com/spreadsheets/" + data[0] + ", tabs"
-		}
-		return "https://docs.google.com/spreadsheets/" + data[0] + "/edit, tabs"
+	res := CELL_RE.FindStringSubmatch(s)
+	if len(res) == 0 {
+		return
 	}
-	if strings.HasSuffix(data[0], "/pubhtml") {
-		return "https://docs.google.com/spreadsheets/" + data[0] + " gid=" + data[1] + " range=" + data[2] + data[3] + ":" + data[4] + data[5]
+	tab, col1, row1, col2, row2 = res[1], res[2], res[3], res[5], res[6]
+	if strings.HasPrefix(tab, "'") {
+		tab = strings.Replace(tab[1:len(tab)-1], "''", "'", -1)
 	}
-	return "https://docs.google.com/spreadsheets/" + data[0] + "/edit#gid=" + data[1] + "&range=" + data[2] + data[3] + ":" + data[4] + data[5]
+	if res[4] == "" {
+		// A single cell needs both a column and a row
+		ok = col1 != "" && row1 != ""
+		return
+	}
+	if col1+row1 == "" || col2+row2 == "" {
+		return
+	}
+	// Whole rows cannot be mixed with columns
+	ok = (col1 == "") == (col2 == "")
+	return
 }
 
-func fetchTable(name string) *string {
-	var url string
-	if strings.HasSuffix(name, "/pubhtml") {
-		url = "https://docs.google.com/spreadsheets/" + name
-	} else {
-		url = "https://docs.google.com/spreadsheets/" + name + "/htmlview"
+func buildEditURL(rec *Record) string {
+	if rec.Kind == KIND_TABS {
+		if rec.Published {
+			return configMap["baseurl"] + rec.Spreadsheet + "/pubhtml, tabs"
+		}
+		return configMap["baseurl"] + rec.Spreadsheet + "/edit, tabs"
 	}
-	resp, err := http.Get(url)
-	if err != nil || resp.StatusCode != 200 {
-		log.Println("Unable to fetch " + name)
-		return nil
+	if rec.Kind == KIND_LOOKUP {
+		if rec.Published {
+			return configMap["baseurl"] + rec.Spreadsheet + "/pubhtml gid=" + rec.Gid
+		}
+		return configMap["baseurl"] + rec.Spreadsheet + "/edit#gid=" + rec.Gid
+	}
+	if rec.Published {
+		return configMap["baseurl"] + rec.Spreadsheet + "/pubhtml gid=" + rec.Gid + " range=" + rec.Col1 + rec.Row1 + ":" + rec.Col2 + rec.Row2
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	result := string(body)
-	return &result
+	return configMap["baseurl"] + rec.Spreadsheet + "/edit#gid=" + rec.Gid + "&range=" + rec.Col1 + rec.Row1 + ":" + rec.Col2 + rec.Row2
 }
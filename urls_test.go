@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestParseA1(t *testing.T) {
+	tests := []struct {
+		in                          string
+		tab, col1, row1, col2, row2 string
+		ok                          bool
+	}{
+		{"B2", "", "B", "2", "", "", true},
+		{"a1:b5", "", "A", "1", "B", "5", true},
+		{"C:C", "", "C", "", "C", "", true},
+		{"3:3", "", "", "3", "", "3", true},
+		{"A2:A", "", "A", "2", "A", "", true},
+		{"'It''s'!B2", "It's", "B", "2", "", "", true},
+		{"Sheet!A1", "Sheet", "A", "1", "", "", true},
+		{"sheet!a1", "sheet", "A", "1", "", "", true},
+		{"'Sheet 2'!A1:B3", "Sheet 2", "A", "1", "B", "3", true},
+		{"A:3", "", "", "", "", "", false},
+		{"A1:3", "", "", "", "", "", false},
+		{"A", "", "", "", "", "", false},
+		{"1", "", "", "", "", "", false},
+		{"", "", "", "", "", "", false},
+		{"A1:", "", "", "", "", "", false},
+	}
+	for _, test := range tests {
+		tab, col1, row1, col2, row2, ok := parseA1(test.in)
+		if ok != test.ok || (ok && (tab != test.tab || col1 != test.col1 || row1 != test.row1 || col2 != test.col2 || row2 != test.row2)) {
+			t.Errorf("parseA1(%q) = %q, %q, %q, %q, %q, %v", test.in, tab, col1, row1, col2, row2, ok)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// WEBHOOK_SHUTDOWN_TIMEOUT is how long the requests in flight are waited for on shutdown.
+const WEBHOOK_SHUTDOWN_TIMEOUT = 10 * time.Second
+
+// MAX_UPDATE_SIZE limits the body of a webhook request.
+const MAX_UPDATE_SIZE = 1 << 20
+
+// webhookServer receives the updates Telegram POSTs to the webhook.
+type webhookServer struct {
+	secret  string
+	updates chan tgbotapi.Update
+	// lock keeps requests from sending into updates after it is closed.
+	lock   sync.RWMutex
+	closed bool
+}
+
+func newWebhookServer(secret string) *webhookServer {
+	return &webhookServer{secret: secret, updates: make(chan tgbotapi.Update, 100)}
+}
+
+// ServeHTTP passes a single update on. Requests without the secret are rejected.
+func (s *webhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.secret)) != 1 {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	var update tgbotapi.Update
+	if err := json.NewDecoder(io.LimitReader(r.Body, MAX_UPDATE_SIZE)).Decode(&update); err != nil {
+		http.Error(w, "Bad update", http.StatusBadRequest)
+		return
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	s.updates <- update
+}
+
+// Close stops accepting updates and closes the channel.
+func (s *webhookServer) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.updates)
+	}
+}
+
+// newWebhookSecret returns a random secret token for the webhook.
+func newWebhookSecret() string {
+	data := make([]byte, 32)
+	rand.Read(data)
+	return hex.EncodeToString(data)
+}
+
+// setWebhook points Telegram to the webhook. The certificate is uploaded, so that a self-signed one works.
+// The secret token is not supported by the bot library, so the request is made directly.
+func setWebhook(bot *tgbotapi.BotAPI, hook string, cert string, secret string) error {
+	params := map[string]string{"url": hook, "secret_token": secret}
+	var resp tgbotapi.APIResponse
+	var err error
+	if cert != "" {
+		resp, err = bot.UploadFile("setWebhook", params, "certificate", cert)
+	} else {
+		values := url.Values{}
+		for k, v := range params {
+			values.Set(k, v)
+		}
+		resp, err = bot.MakeRequest("setWebhook", values)
+	}
+	if err != nil {
+		return err
+	}
+	if !resp.Ok {
+		return errors.New(resp.Description)
+	}
+	return nil
+}
+
+// listenWebhook registers the webhook and serves it until shutdown is closed.
+// Without -secret, a new secret is made on every start, as the webhook is set again anyway.
+// The returned channel is closed once the server has shut down.
+func listenWebhook(bot *tgbotapi.BotAPI, shutdown <-chan struct{}) <-chan tgbotapi.Update {
+	hook, err := url.Parse(configMap["webhook"])
+	if err != nil {
+		log.Panic("Bad webhook URL: " + err.Error())
+	}
+	secret := configMap["secret"]
+	if secret == "" {
+		secret = newWebhookSecret()
+	}
+	if err := setWebhook(bot, configMap["webhook"], configMap["cert"], secret); err != nil {
+		log.Panic("Could not set the webhook: " + err.Error())
+	}
+	path := hook.Path
+	if path == "" {
+		path = "/"
+	}
+	hooks := newWebhookServer(secret)
+	mux := http.NewServeMux()
+	mux.Handle(path, hooks)
+	server := &http.Server{Addr: configMap["listen"], Handler: mux}
+	go func() {
+		<-shutdown
+		log.Println("Shutting down the webhook server")
+		ctx, cancel := context.WithTimeout(context.Background(), WEBHOOK_SHUTDOWN_TIMEOUT)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println(err.Error())
+		}
+		hooks.Close()
+	}()
+	go func() {
+		var err error
+		if configMap["cert"] != "" {
+			err = server.ListenAndServeTLS(configMap["cert"], configMap["key"])
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Panic(err)
+		}
+	}()
+	log.Printf("Listening for the webhook %s on %s", configMap["webhook"], configMap["listen"])
+	return hooks.updates
+}
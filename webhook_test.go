@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookServer(t *testing.T) {
+	hooks := newWebhookServer("s3cret")
+	srv := httptest.NewServer(hooks)
+	defer srv.Close()
+	post := func(token string, body string) int {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("X-Telegram-Bot-Api-Secret-Token", token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	update := `{"update_id":5,"message":{"message_id":1,"chat":{"id":42},"text":"/help"}}`
+
+	if code := post("s3cret", update); code != http.StatusOK {
+		t.Errorf("valid update: status %d", code)
+	}
+	select {
+	case u := <-hooks.updates:
+		if u.UpdateID != 5 || u.Message == nil || u.Message.Chat.ID != 42 || u.Message.Text != "/help" {
+			t.Errorf("received update = %+v", u)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the update did not reach the channel")
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		body  string
+		want  int
+	}{
+		{"wrong token", "wrong", update, http.StatusForbidden},
+		{"no token", "", update, http.StatusForbidden},
+		{"bad body", "s3cret", "{not json", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		if code := post(test.token, test.body); code != test.want {
+			t.Errorf("%s: status %d, want %d", test.name, code, test.want)
+		}
+	}
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+	if len(hooks.updates) != 0 {
+		t.Errorf("%d rejected updates reached the channel", len(hooks.updates))
+	}
+
+	hooks.Close()
+	if code := post("s3cret", update); code != http.StatusServiceUnavailable {
+		t.Errorf("after Close: status %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if _, ok := <-hooks.updates; ok {
+		t.Error("the channel is open after Close")
+	}
+}